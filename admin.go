@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminToken を Authorization: Bearer で渡したリクエストだけを通す
+// adminToken が未設定の場合は管理用のエンドポイントを使えない
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" || !isAdminRequest(r) {
+			denyAdmin(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// /_/reload は以前から認証なしで使えたため、adminToken を設定したときだけ保護する
+func requireAdminIfConfigured(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken != "" && !isAdminRequest(r) {
+			denyAdmin(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func isAdminRequest(r *http.Request) bool {
+	if len(config.AdminAllowedCIDRs) > 0 && !adminSourceAllowed(r) {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// X-Forwarded-For から取った clientIP ではなく、偽れない接続元のアドレスで判定する
+func adminSourceAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, cidr := range config.AdminAllowedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hideAdminEndpoints のときは管理用のエンドポイントがあること自体を見せない
+func denyAdmin(w http.ResponseWriter) {
+	if config.HideAdminEndpoints {
+		http.NotFound(w, nil)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET で各ルートのメンテナンス状態を返し、POST ?backend=&enabled= で切り替える
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		key := r.URL.Query().Get("backend")
+		rt, ok := routes[key]
+		if !ok {
+			http.Error(w, "unknown backend", http.StatusNotFound)
+			return
+		}
+		rt.maintenance.Store(r.URL.Query().Get("enabled") == "true")
+	}
+
+	states := map[string]bool{}
+	for key, rt := range routes {
+		states[key] = rt.maintenance.Load()
+	}
+	writeJSON(w, states)
+}
+
+// POST /_/backends/drain?backend=<キー>
+// 再デプロイしたバックエンドだけ、設定を読み直さずにコネクションプールを空にする
+func handleBackendDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("backend")
+	rt, ok := routes[key]
+	if !ok {
+		http.Error(w, "unknown backend", http.StatusNotFound)
+		return
+	}
+	rt.closeIdleConnections()
+	log.Printf("Closed idle connections for backend %s", key)
+	w.Write([]byte("ok"))
+}
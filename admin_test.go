@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	return r
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"adminToken": "secret",
+		"maintenancePage": "<p>back soon</p>"
+	}`)
+
+	rec := httptest.NewRecorder()
+	requireAdmin(handleMaintenance)(rec, adminRequest("POST", "/_/maintenance?backend=app.test&enabled=true"))
+	if !strings.Contains(rec.Body.String(), `"app.test":true`) {
+		t.Fatalf("maintenance state = %s", rec.Body.String())
+	}
+	rec = serveProxy(appRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<p>back soon</p>" {
+		t.Errorf("in maintenance: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	requireAdmin(handleMaintenance)(rec, adminRequest("POST", "/_/maintenance?backend=app.test&enabled=false"))
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Errorf("after maintenance: got %d", rec.Code)
+	}
+}
+
+func TestMaintenanceSurvivesReload(t *testing.T) {
+	backend := textBackend(t, "ok")
+	configJSON := `{"backends": {"app.test": "` + backend.URL + `", "other.test": "` + backend.URL + `"}}`
+	useConfig(t, configJSON)
+	routes["app.test"].maintenance.Store(true)
+
+	if err := applyConfigJson([]byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	if !routes["app.test"].maintenance.Load() || routes["other.test"].maintenance.Load() {
+		t.Error("reload did not keep the maintenance state")
+	}
+
+	// ファイルの maintenance を変えたときはそちらに従う
+	routes["app.test"].maintenance.Store(false)
+	inMaintenance := `{"backends": {"app.test": {"url": "` + backend.URL + `", "maintenance": true}}}`
+	if err := applyConfigJson([]byte(inMaintenance)); err != nil {
+		t.Fatal(err)
+	}
+	if !routes["app.test"].maintenance.Load() {
+		t.Error("maintenance in the file was not applied")
+	}
+	routes["app.test"].maintenance.Store(false)
+	if err := applyConfigJson([]byte(inMaintenance)); err != nil {
+		t.Fatal(err)
+	}
+	if routes["app.test"].maintenance.Load() {
+		t.Error("reload undid turning maintenance off at runtime")
+	}
+}
+
+func TestAdminEndpointsHidden(t *testing.T) {
+	for _, tt := range []struct {
+		configJSON string
+		want       int
+	}{
+		{`{"adminToken": "secret"}`, http.StatusUnauthorized},
+		{`{"adminToken": "secret", "hideAdminEndpoints": true}`, http.StatusNotFound},
+		// adminToken がなければ管理用のエンドポイントは使えない
+		{`{"hideAdminEndpoints": true}`, http.StatusNotFound},
+	} {
+		useConfig(t, tt.configJSON)
+		r := httptest.NewRequest("GET", "/_/maintenance", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+		rec := httptest.NewRecorder()
+		requireAdmin(handleMaintenance)(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.configJSON, rec.Code, tt.want)
+		}
+	}
+
+	useConfig(t, `{"adminToken": "secret", "hideAdminEndpoints": true}`)
+	rec := httptest.NewRecorder()
+	requireAdmin(handleMaintenance)(rec, adminRequest("GET", "/_/maintenance"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("with the token: got %d", rec.Code)
+	}
+}
+
+func TestAdminAllowedCIDRs(t *testing.T) {
+	useConfig(t, `{"adminToken": "secret", "adminAllowedCIDRs": ["10.0.0.0/8"]}`)
+	for _, tt := range []struct {
+		remoteAddr, xff string
+		want            int
+	}{
+		{"10.1.2.3:5000", "", http.StatusOK},
+		{"192.0.2.1:5000", "", http.StatusUnauthorized},
+		// X-Forwarded-For は偽れるので見ない
+		{"192.0.2.1:5000", "10.1.2.3", http.StatusUnauthorized},
+	} {
+		r := adminRequest("GET", "/_/maintenance")
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		rec := httptest.NewRecorder()
+		requireAdmin(handleMaintenance)(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("from %s (xff %q): got %d, want %d", tt.remoteAddr, tt.xff, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestBackendDrain(t *testing.T) {
+	backend, conns := countingBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "adminToken": "secret"}`)
+
+	serveProxy(appRequest("GET", "/", nil))
+	serveProxy(appRequest("GET", "/", nil))
+	rec := httptest.NewRecorder()
+	requireAdmin(handleBackendDrain)(rec, adminRequest("POST", "/_/backends/drain?backend=app.test"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("drain: got %d", rec.Code)
+	}
+	serveProxy(appRequest("GET", "/", nil))
+	if got := conns.Load(); got != 2 {
+		t.Errorf("backend saw %d connections, want a new one after draining", got)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/_/backends/drain?backend=app.test", http.StatusMethodNotAllowed},
+		{"POST", "/_/backends/drain?backend=missing.test", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		requireAdmin(handleBackendDrain)(rec, adminRequest(tt.method, tt.target))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.target, rec.Code, tt.want)
+		}
+	}
+}
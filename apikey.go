@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// apiKeyHeader の値の SHA-256 (16 進) が apiKeyHashes のどれかと一致すれば通す
+// ローテーション中は新旧両方のハッシュを並べておく
+func validAPIKey(r *http.Request, backend Backend) bool {
+	key := r.Header.Get(backend.APIKeyHeader)
+	if key == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(key))
+	valid := false
+	for _, h := range backend.APIKeyHashes {
+		want, err := hex.DecodeString(h)
+		if err != nil {
+			continue
+		}
+		// 一致したかどうかで処理時間が変わらないよう、途中で抜けない
+		if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func validateAPIKeyHashes(hashes []string) error {
+	for _, h := range hashes {
+		if b, err := hex.DecodeString(h); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid apiKeyHashes entry %q: want hex-encoded SHA-256", h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyHeader(t *testing.T) {
+	backend := textBackend(t, "ok")
+	// ローテーション中は新旧 2 つのキーを受け付ける
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "apiKeyHeader": "X-API-Key", "apiKeyHashes": [%q, %q]}}}`,
+		backend.URL, sha256Hex("old-key"), sha256Hex("new-key")))
+
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{
+		{"old-key", http.StatusOK},
+		{"new-key", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		r := appRequest("GET", "/", nil)
+		if tt.key != "" {
+			r.Header.Set("X-API-Key", tt.key)
+		}
+		if rec := serveProxy(r); rec.Code != tt.want {
+			t.Errorf("key %q: got %d, want %d", tt.key, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyHashesValidated(t *testing.T) {
+	for _, hashes := range []string{`[]`, `["abc"]`, `["` + strings.Repeat("z", 64) + `"]`} {
+		err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "apiKeyHeader": "X-API-Key", "apiKeyHashes": ` + hashes + `}}}`))
+		if err == nil {
+			t.Errorf("apiKeyHashes %s was accepted", hashes)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// backends の各値。文字列だけを書いた場合は URL として扱う
+type Backend struct {
+	URL                     string            `json:"url"`
+	Instances               []Instance        `json:"instances"`             // 指定すると url の代わりにこれらへ振り分ける
+	LoadBalancing           string            `json:"loadBalancing"`         // roundRobin (既定) / consistentHash
+	HashKey                 string            `json:"hashKey"`               // consistentHash のキー: path (既定) / header:<名前> / cookie:<名前>
+	ExpectContinue          string            `json:"expectContinue"`        // relay (既定) / respond
+	ExpectContinueTimeout   int               `json:"expectContinueTimeout"` // ミリ秒
+	DisableKeepAlive        bool              `json:"disableKeepAlive"`      // リクエストごとに新しい接続を張る
+	ResponseTimeout         int               `json:"responseTimeout"`       // ミリ秒、レスポンスヘッダーが返るまで
+	SecondaryBackend        string            `json:"secondaryBackend"`      // タイムアウトや 5xx のときの切り替え先
+	DefaultContentType      string            `json:"defaultContentType"`    // 未設定ならグローバルの defaultContentType
+	MirrorTo                string            `json:"mirrorTo"`              // リクエストの写しを送る先
+	MirrorBodyBytes         int               `json:"mirrorBodyBytes"`       // 0 の場合は本文を送らない
+	Maintenance             bool              `json:"maintenance"`           // 起動時のメンテナンス状態。/_/maintenance で切り替える
+	AllowedContentTypes     []string          `json:"allowedContentTypes"`   // 空の場合はすべて許可
+	SourceAddress           string            `json:"sourceAddress"`         // バックエンドへの接続に使う送信元 IP
+	JSONRewrite             JSONRewriteConfig `json:"jsonRewrite"`
+	Streaming               bool              `json:"streaming"`               // requestTimeout の代わりに streamingTimeout を使う
+	RetryOnEmptyResponse    bool              `json:"retryOnEmptyResponse"`    // 応答なしで切断された冪等なリクエストを送り直す
+	MaxResponseBytes        int64             `json:"maxResponseBytes"`        // これを超えるレスポンスは打ち切る。0 の場合は無制限
+	UpstreamServerName      string            `json:"upstreamServerName"`      // https のバックエンドに送る SNI。証明書の検証にも使う
+	DecompressRequestBody   bool              `json:"decompressRequestBody"`   // gzip の本文を展開してから転送する
+	APIKeyHeader            string            `json:"apiKeyHeader"`            // 設定するとこのヘッダーのキーを検査し、無効なら 401
+	APIKeyHashes            []string          `json:"apiKeyHashes"`            // 有効なキーの SHA-256 (16 進)
+	InstanceCooldown        int               `json:"instanceCooldown"`        // 秒。接続できなかったインスタンスをこの間だけ外す
+	AllDownBackend          string            `json:"allDownBackend"`          // すべてのインスタンスが外れているときの送り先
+	AllDownBody             string            `json:"allDownBody"`             // allDownBackend がない場合に 503 で返す本文
+	EmptyPoolPolicy         string            `json:"emptyPoolPolicy"`         // allDown* がないとき。fail: 503 を返す / tryLastResort: 失敗が最も古いインスタンスに送る / 未設定: 外れたものにも順に送る
+	PathRules               []PathRule        `json:"pathRules"`               // 指定するとどれかに allow で一致したパスとメソッドだけを通す
+	AuthSchemeBackends      map[string]string `json:"authSchemeBackends"`      // {"bearer": URL, "basic": URL, "none": URL}。一致しなければ url / instances
+	BackendReadTimeout      int               `json:"backendReadTimeout"`      // ミリ秒、バックエンドからの 1 回の読み込みを待つ時間
+	BackendWriteTimeout     int               `json:"backendWriteTimeout"`     // ミリ秒、バックエンドへの 1 回の書き込みを待つ時間
+	FlushStatuses           []int             `json:"flushStatuses"`           // 指定するとこのステータスのレスポンスだけをすぐに送り出し、ほかはためる
+	RequestBodyTemplate     string            `json:"requestBodyTemplate"`     // JSON の本文を書き換える text/template。{"data": {{json .Body}}} など
+	RequestBodyMaxBytes     int               `json:"requestBodyMaxBytes"`     // これより大きい本文は書き換えない
+	TCPNoDelay              *bool             `json:"tcpNoDelay"`              // 未指定なら Go の既定 (true)
+	PropagateTraceparent    bool              `json:"propagateTraceparent"`    // W3C の traceparent を引き継ぐか新しく作ってバックエンドに渡す
+	TLSRenegotiation        string            `json:"tlsRenegotiation"`        // https のバックエンドからの再ネゴシエーション: never (既定) / once / freely
+	RequirePathPrefix       string            `json:"requirePathPrefix"`       // 設定するとこれで始まらないパスは 404。誤った振り分けへの安全策
+	UpstreamAcceptEncoding  *string           `json:"upstreamAcceptEncoding"`  // バックエンドに送る Accept-Encoding。"" で取り除く。未指定ならそのまま
+	StripTrailers           []string          `json:"stripTrailers"`           // クライアントに送らないトレーラー
+	LogTrailers             []string          `json:"logTrailers"`             // 値をログに残すトレーラー
+	StatusMap               []StatusMapping   `json:"statusMap"`               // バックエンドの 5xx などをクライアント向けのステータスと本文に置き換える
+	UpstreamProtocol        string            `json:"upstreamProtocol"`        // auto (既定) / http1 / http2 (https のバックエンドのみ)
+	MethodRewrite           map[string]string `json:"methodRewrite"`           // {"PATCH": "POST"} のように転送するメソッドを置き換える
+	MethodOverrideHeader    bool              `json:"methodOverrideHeader"`    // 置き換えたときに元のメソッドを X-HTTP-Method-Override で渡す
+	MaxRequestsPerConn      int               `json:"maxRequestsPerConn"`      // この数のリクエストを送った接続は閉じて張り直す
+	InjectLatency           *LatencyInjection `json:"injectLatency"`           // chaosEnabled のときだけ転送前に待つ
+	InjectError             *ErrorInjection   `json:"injectError"`             // chaosEnabled のときだけ返す
+	ConnectTimeout          int               `json:"connectTimeout"`          // ミリ秒、TCP の接続まで。0 の場合は 30 秒
+	TLSHandshakeTimeout     int               `json:"tlsHandshakeTimeout"`     // ミリ秒、https のバックエンドとの TLS ハンドシェイク。0 の場合は 10 秒
+	CoalesceRequests        bool              `json:"coalesceRequests"`        // 同時に来た同じ GET は 1 つだけ送って結果を分け合う
+	MaxWebSocketConns       int               `json:"maxWebSocketConns"`       // 同時に開いておける WebSocket の数。超えた Upgrade には 503 を返す。0 の場合は無制限
+	ResponseHeaderAllowlist []string          `json:"responseHeaderAllowlist"` // 設定するとこれ以外のレスポンスヘッダーを返さない
+	IdempotencyKeyTTL       int               `json:"idempotencyKeyTTL"`       // 秒。設定すると同じ Idempotency-Key の POST などに最初のレスポンスを返す
+	IdempotencyKeyHeader    string            `json:"idempotencyKeyHeader"`    // 既定は Idempotency-Key
+}
+
+func (b *Backend) UnmarshalJSON(data []byte) error {
+	var rawURL string
+	if err := json.Unmarshal(data, &rawURL); err == nil {
+		*b = Backend{URL: rawURL}
+		return nil
+	}
+	type plain Backend
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// 設定の読み込み時に値を検査する
+func (b Backend) validate() error {
+	if b.URL == "" && len(b.Instances) == 0 {
+		return errors.New("backend needs url or instances")
+	}
+	switch b.LoadBalancing {
+	case "", "roundRobin", "consistentHash":
+	default:
+		return fmt.Errorf("unknown loadBalancing %q", b.LoadBalancing)
+	}
+	if b.APIKeyHeader != "" {
+		if len(b.APIKeyHashes) == 0 {
+			return errors.New("apiKeyHeader needs apiKeyHashes")
+		}
+		if err := validateAPIKeyHashes(b.APIKeyHashes); err != nil {
+			return err
+		}
+	}
+	for from, to := range b.MethodRewrite {
+		if !knownMethod(from) || !knownMethod(to) {
+			return fmt.Errorf("invalid methodRewrite %q -> %q", from, to)
+		}
+	}
+	for _, instance := range b.Instances {
+		if instance.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for instance %s", instance.Weight, instance.URL)
+		}
+	}
+	switch b.EmptyPoolPolicy {
+	case "", "fail", "tryLastResort":
+	default:
+		return fmt.Errorf("unknown emptyPoolPolicy %q", b.EmptyPoolPolicy)
+	}
+	switch b.UpstreamProtocol {
+	case "", "auto", "http1", "http2":
+	default:
+		return fmt.Errorf("unknown upstreamProtocol %q", b.UpstreamProtocol)
+	}
+	switch b.TLSRenegotiation {
+	case "", "never", "once", "freely":
+	default:
+		return fmt.Errorf("unknown tlsRenegotiation %q", b.TLSRenegotiation)
+	}
+	if b.InjectError != nil && (b.InjectError.Status < 400 || b.InjectError.Status > 599) {
+		return fmt.Errorf("invalid injectError status %d", b.InjectError.Status)
+	}
+	if b.InjectError != nil && (b.InjectError.Probability < 0 || b.InjectError.Probability > 1) {
+		return fmt.Errorf("invalid injectError probability %g", b.InjectError.Probability)
+	}
+	if b.SourceAddress != "" && net.ParseIP(b.SourceAddress) == nil {
+		return fmt.Errorf("invalid sourceAddress %q", b.SourceAddress)
+	}
+	return nil
+}
+
+// Go の TLS サーバーは再ネゴシエーションに対応しないため、使えるのはバックエンドへの接続だけ
+func tlsRenegotiation(value string) tls.RenegotiationSupport {
+	switch value {
+	case "once":
+		return tls.RenegotiateOnceAsClient
+	case "freely":
+		return tls.RenegotiateFreelyAsClient
+	}
+	return tls.RenegotiateNever
+}
+
+func knownMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func newDialer(backend Backend, cfg *Config) *net.Dialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: backendResolver(cfg.ResolverAddress)}
+	if backend.ConnectTimeout > 0 {
+		dialer.Timeout = time.Duration(backend.ConnectTimeout) * time.Millisecond
+	}
+	if backend.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(backend.SourceAddress)}
+	}
+	return dialer
+}
+
+// バックエンドごとの Transport を作る
+// 読み直しのときは、まだ差し替えていない新しい設定を cfg で受け取る
+func newTransport(backend Backend, cfg *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if backend.ExpectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = time.Duration(backend.ExpectContinueTimeout) * time.Millisecond
+	}
+	transport.DisableKeepAlives = backend.DisableKeepAlive
+	// Accept-Encoding を決めたときは、Transport が勝手に gzip を付けて展開しないようにする
+	transport.DisableCompression = backend.UpstreamAcceptEncoding != nil
+	if backend.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(backend.TLSHandshakeTimeout) * time.Millisecond
+	}
+	if cfg.BackendIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = seconds(cfg.BackendIdleConnTimeout)
+	}
+	dialer := newDialer(backend, cfg)
+	transport.DialContext = dialer.DialContext
+	if cfg.DNSCacheTTL > 0 {
+		transport.DialContext = backendDNS.dialContext(dialer)
+	}
+	if backend.UpstreamServerName != "" || backend.TLSRenegotiation != "" || backend.UpstreamProtocol != "" {
+		transport.TLSClientConfig = &tls.Config{
+			ServerName:    backend.UpstreamServerName,
+			Renegotiation: tlsRenegotiation(backend.TLSRenegotiation),
+		}
+	}
+	// http2 でも ALPN には http/1.1 が足されてしまうので、外れたレスポンスは requireHTTP2 で弾く
+	switch backend.UpstreamProtocol {
+	case "http1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case "http2":
+		transport.ForceAttemptHTTP2 = true
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+	if backend.TCPNoDelay != nil {
+		dial := transport.DialContext
+		noDelay := *backend.TCPNoDelay
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetNoDelay(noDelay)
+			}
+			return conn, err
+		}
+	}
+	if backend.BackendReadTimeout > 0 || backend.BackendWriteTimeout > 0 {
+		dial := transport.DialContext
+		readTimeout := time.Duration(backend.BackendReadTimeout) * time.Millisecond
+		writeTimeout := time.Duration(backend.BackendWriteTimeout) * time.Millisecond
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &deadlineConn{Conn: conn, readTimeout: readTimeout, writeTimeout: writeTimeout}, nil
+		}
+	}
+	if backend.MaxRequestsPerConn > 0 {
+		transport.DialContext = countConns(transport.DialContext)
+	}
+	if backend.ResponseTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(backend.ResponseTimeout) * time.Millisecond
+	}
+	return transport
+}
+
+// 読み書きのたびに期限を置き直す接続。遅いバックエンドを接続単位で打ち切る
+// プールで待っている接続も readTimeout が過ぎると閉じられる
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+func newProxy(backend Backend, cfg *Config, target string) (*httputil.ReverseProxy, error) {
+	proxyURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	statusMap, err := compileStatusMappings(backend.StatusMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// 平文の h2c には対応しないので、http2 を指定できるのは https だけ
+	if backend.UpstreamProtocol == "http2" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("upstreamProtocol http2 needs an https backend, got %s", target)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(proxyURL)
+	proxy.Transport = newTransport(backend, cfg)
+	if backend.UpstreamProtocol == "http2" {
+		proxy.Transport = requireHTTP2{proxy.Transport}
+	}
+	if backend.MaxRequestsPerConn > 0 {
+		proxy.Transport = connReuseLimit{proxy.Transport, int64(backend.MaxRequestsPerConn)}
+	}
+	if backend.RetryOnEmptyResponse {
+		proxy.Transport = retryTransport{proxy.Transport}
+	}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		stripHeaders(req.Header, config.StripHopByHopHeaders.Request)
+		if method, ok := backend.MethodRewrite[req.Method]; ok {
+			if backend.MethodOverrideHeader {
+				req.Header.Set("X-HTTP-Method-Override", req.Method)
+			}
+			req.Method = method
+		}
+		if backend.UpstreamAcceptEncoding != nil {
+			if *backend.UpstreamAcceptEncoding == "" {
+				req.Header.Del("Accept-Encoding")
+			} else {
+				req.Header.Set("Accept-Encoding", *backend.UpstreamAcceptEncoding)
+			}
+		}
+		// respond: 100 Continue はプロキシが返し、バックエンドには Expect を送らない
+		if backend.ExpectContinue == "respond" {
+			req.Header.Del("Expect")
+		}
+	}
+
+	if len(backend.FlushStatuses) > 0 {
+		// 送り出すかどうかは flushByStatusWriter がステータスを見て決める
+		proxy.FlushInterval = -1
+	}
+	proxy.ErrorHandler = proxyErrorHandler
+	proxy.ModifyResponse = func(response *http.Response) error {
+		// バックエンドが付けたものだけが対象。プロキシが後で付けるヘッダーは残る
+		// 101 の Upgrade / Connection を消すと ReverseProxy が切り替えられず 502 になるので触らない
+		if len(backend.ResponseHeaderAllowlist) > 0 && response.StatusCode != http.StatusSwitchingProtocols {
+			allowHeaders(response.Header, backend.ResponseHeaderAllowlist)
+		}
+		if err := mapUpstreamStatus(response, statusMap); err != nil {
+			return err
+		}
+		response.Header.Set("X-Your-Custom-Header", "Value")
+		if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+			extendForStreaming(response.Request.Context())
+		}
+		handleTrailers(response, backend)
+		if err := limitResponseBody(response, backend.MaxResponseBytes); err != nil {
+			return err
+		}
+		setDefaultContentType(response, backend)
+		setServerTiming(response)
+		stripHeaders(response.Header, config.StripHopByHopHeaders.Response)
+		return rewriteJSONResponse(response, backend.JSONRewrite)
+	}
+	return proxy, nil
+}
+
+var errNotHTTP2 = errors.New("backend did not negotiate HTTP/2")
+
+// upstreamProtocol が http2 のとき、HTTP/1.1 で返ってきたレスポンスを 502 にする
+type requireHTTP2 struct {
+	http.RoundTripper
+}
+
+func (t requireHTTP2) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: got %s from %s", errNotHTTP2, resp.Proto, req.URL.Host)
+	}
+	return resp, nil
+}
+
+func (t requireHTTP2) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Content-Length で上限を超えると分かる場合は 502 にする
+// それ以外は読みながら数え、超えたところで本文を打ち切る
+// エラーを返すと ReverseProxy が接続を切ってしまうので、上限までで終わったことにする
+func limitResponseBody(response *http.Response, maxBytes int64) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if response.ContentLength > maxBytes {
+		response.Body.Close()
+		return fmt.Errorf("response from %s is %d bytes, exceeds maxResponseBytes %d", response.Request.URL.Host, response.ContentLength, maxBytes)
+	}
+	response.Body = &limitedBody{ReadCloser: response.Body, remaining: maxBytes, host: response.Request.URL.Host, max: maxBytes}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	host      string
+	max       int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		log.Printf("Response from %s exceeded maxResponseBytes %d, truncating", b.host, b.max)
+		return n + int(b.remaining), io.EOF
+	}
+	return n, err
+}
+
+// Content-Type のないレスポンスに既定値を付けてブラウザの推測を防ぐ
+func setDefaultContentType(response *http.Response, backend Backend) {
+	contentType := backend.DefaultContentType
+	if contentType == "" {
+		contentType = config.DefaultContentType
+	}
+	if contentType == "" || response.Header.Get("Content-Type") != "" {
+		return
+	}
+	if response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified {
+		return
+	}
+	response.Header.Set("Content-Type", contentType)
+}
+
+// タイムアウトは 504、それ以外は 502 を返す
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) || requestTimedOut(r.Context()) {
+		writeUpstreamError(w, r, http.StatusGatewayTimeout, err)
+		return
+	}
+	writeUpstreamError(w, r, http.StatusBadGateway, err)
+}
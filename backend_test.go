@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// handleProxy を本物のサーバーで動かす。100-continue や Upgrade など、レコーダーでは試せないもの向け
+// Hijack した接続のハンドラーは Close を待たないので、設定を戻す前に終わるのを待つ
+func newProxyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var handlers sync.WaitGroup
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleProxy(w, r)
+	}))
+	// port2 のリスナーと同じく、接続から読んだバイトでメッセージの区切りを追う
+	server.Listener = newFramingListener(server.Listener)
+	server.Config.ConnContext = framingConnContext
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+	})
+	return server
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, mode := range []string{"relay", "respond"} {
+		t.Run(mode, func(t *testing.T) {
+			var gotExpect, gotBody string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotExpect = r.Header.Get("Expect")
+				body, _ := io.ReadAll(r.Body)
+				gotBody = string(body)
+			}))
+			defer backend.Close()
+			useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "expectContinue": "`+mode+`"}}}`)
+			proxy := newProxyServer(t)
+
+			req, _ := http.NewRequest("POST", proxy.URL+"/upload", strings.NewReader("payload"))
+			req.Host = "app.test"
+			req.Header.Set("Expect", "100-continue")
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if gotBody != "payload" {
+				t.Errorf("backend got body %q", gotBody)
+			}
+			want := "100-continue"
+			if mode == "respond" {
+				want = ""
+			}
+			if gotExpect != want {
+				t.Errorf("backend got Expect %q, want %q", gotExpect, want)
+			}
+		})
+	}
+}
+
+// バックエンドが受けた TCP 接続の数を数える
+func countingBackend(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(handler)
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	return backend, &conns
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		backend, conns := countingBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+		useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "disableKeepAlive": %t}}}`, backend.URL, disable))
+		for i := 0; i < 3; i++ {
+			serveProxy(appRequest("GET", "/", nil))
+		}
+		want := int64(1)
+		if disable {
+			want = 3
+		}
+		if got := conns.Load(); got != want {
+			t.Errorf("disableKeepAlive %t: backend saw %d connections, want %d", disable, got, want)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nil にしておくと net/http が本文から推測しない
+		w.Header()["Content-Type"] = nil
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte("<b>hi</b>"))
+	}))
+	defer backend.Close()
+
+	useConfig(t, `{
+		"backends": {
+			"app.test": "`+backend.URL+`",
+			"api.test": {"url": "`+backend.URL+`", "defaultContentType": "application/json"}
+		},
+		"defaultContentType": "application/octet-stream"
+	}`)
+	for _, tt := range []struct{ host, path, want string }{
+		{"app.test", "/", "application/octet-stream"},
+		{"api.test", "/", "application/json"},
+		{"app.test", "/typed", "image/png"},
+		{"app.test", "/empty", ""},
+	} {
+		r := appRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		if got := serveProxy(r).Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("%s%s: Content-Type %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "sourceAddress": "not-an-ip"}}}`)); err == nil {
+		t.Error("invalid sourceAddress was accepted")
+	}
+
+	// Linux ではループバックの 127.0.0.0/8 のどのアドレスからでも接続できる
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 is not usable here: %v", err)
+	} else {
+		ln.Close()
+	}
+	var remote string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "sourceAddress": "127.0.0.2"}}}`)
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if remote != "127.0.0.2" {
+		t.Errorf("backend saw a connection from %s", remote)
+	}
+}
+
+func TestBackendIdleConnTimeout(t *testing.T) {
+	backend, conns := countingBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "backendIdleConnTimeout": 1}`)
+
+	serveProxy(appRequest("GET", "/", nil))
+	time.Sleep(1500 * time.Millisecond)
+	serveProxy(appRequest("GET", "/", nil))
+	if got := conns.Load(); got != 2 {
+		t.Errorf("backend saw %d connections, want 2 after the idle one was closed", got)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/chunked" {
+			// Flush すると Content-Length が付かない
+			w.Write([]byte(body[:50]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[50:]))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "maxResponseBytes": 60}}}`)
+
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusBadGateway {
+		t.Errorf("Content-Length over the limit: got %d, want 502", rec.Code)
+	}
+
+	testLog.Reset()
+	rec := serveProxy(appRequest("GET", "/chunked", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 60 {
+		t.Errorf("chunked over the limit: got %d with %d bytes, want 60", rec.Code, rec.Body.Len())
+	}
+	if !strings.Contains(testLog.String(), "exceeded maxResponseBytes 60") {
+		t.Error("truncation was not logged")
+	}
+	if entry := lastAccessLog(t); entry["path"] != "/chunked" {
+		t.Errorf("access log = %v", entry)
+	}
+}
+
+// requireHTTP2 などで包まれていても元の *http.Transport を返す
+func baseTransport(rt http.RoundTripper) *http.Transport {
+	switch wrapped := rt.(type) {
+	case requireHTTP2:
+		return baseTransport(wrapped.RoundTripper)
+	case connReuseLimit:
+		return baseTransport(wrapped.RoundTripper)
+	}
+	return rt.(*http.Transport)
+}
+
+// httptest の TLS サーバーの証明書をルートの Transport に信頼させる
+func trustTLSBackend(t *testing.T, rt *route, backend *httptest.Server) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	for _, proxy := range rt.proxies {
+		transport := baseTransport(proxy.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+}
+
+func TestUpstreamServerName(t *testing.T) {
+	var gotSNI string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSNI = r.TLS.ServerName
+	}))
+	defer backend.Close()
+
+	// httptest の証明書は example.com と 127.0.0.1 用
+	for _, tt := range []struct {
+		serverName string
+		want       int
+	}{
+		{"example.com", http.StatusOK},
+		{"other.test", http.StatusBadGateway},
+	} {
+		gotSNI = ""
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "upstreamServerName": "`+tt.serverName+`"}}}`)
+		trustTLSBackend(t, routes["app.test"], backend)
+		if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.serverName, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && gotSNI != tt.serverName {
+			t.Errorf("%s: backend saw SNI %q", tt.serverName, gotSNI)
+		}
+	}
+}
+
+func TestBackendReadTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("fast"))
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "backendReadTimeout": 50}}}`)
+
+	start := time.Now()
+	if rec := serveProxy(appRequest("GET", "/slow", nil)); rec.Code != http.StatusBadGateway {
+		t.Errorf("slow backend: got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow backend took %v", elapsed)
+	}
+	if rec := serveProxy(appRequest("GET", "/fast", nil)); rec.Body.String() != "fast" {
+		t.Errorf("fast backend: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTLSRenegotiation(t *testing.T) {
+	for value, want := range map[string]tls.RenegotiationSupport{
+		"never":  tls.RenegotiateNever,
+		"once":   tls.RenegotiateOnceAsClient,
+		"freely": tls.RenegotiateFreelyAsClient,
+	} {
+		useConfig(t, `{"backends": {"app.test": {"url": "https://127.0.0.1:1", "tlsRenegotiation": "`+value+`"}}}`)
+		transport := routes["app.test"].proxies[0].Transport.(*http.Transport)
+		if got := transport.TLSClientConfig.Renegotiation; got != want {
+			t.Errorf("%s: Renegotiation = %v, want %v", value, got, want)
+		}
+	}
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "https://127.0.0.1:1", "tlsRenegotiation": "always"}}}`)); err == nil {
+		t.Error("unknown tlsRenegotiation was accepted")
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	var gotProto int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProto = r.ProtoMajor
+	})
+	h2Backend := httptest.NewUnstartedServer(handler)
+	h2Backend.EnableHTTP2 = true
+	h2Backend.StartTLS()
+	defer h2Backend.Close()
+	h1Backend := httptest.NewTLSServer(handler)
+	defer h1Backend.Close()
+
+	for _, tt := range []struct {
+		protocol string
+		backend  *httptest.Server
+		status   int
+		proto    int
+	}{
+		{"http2", h2Backend, http.StatusOK, 2},
+		{"http1", h2Backend, http.StatusOK, 1},
+		{"auto", h2Backend, http.StatusOK, 2},
+		// HTTP/1.1 で返ってきたレスポンスはクライアントに渡さない
+		{"http2", h1Backend, http.StatusBadGateway, 1},
+	} {
+		gotProto = 0
+		useConfig(t, `{"backends": {"app.test": {"url": "`+tt.backend.URL+`", "upstreamProtocol": "`+tt.protocol+`"}}}`)
+		trustTLSBackend(t, routes["app.test"], tt.backend)
+		rec := serveProxy(appRequest("GET", "/", nil))
+		if rec.Code != tt.status || gotProto != tt.proto {
+			t.Errorf("%s: got %d, backend saw HTTP/%d", tt.protocol, rec.Code, gotProto)
+		}
+		if tt.status == http.StatusBadGateway {
+			if entries := logsWithMessage(t, "upstream error"); len(entries) != 1 || entries[0]["error_kind"] != "protocol" {
+				t.Errorf("%s: upstream error log = %v", tt.protocol, entries)
+			}
+		}
+	}
+
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "upstreamProtocol": "http2"}}}`)); err == nil {
+		t.Error("http2 with a plain http backend was accepted")
+	}
+}
+
+func TestMethodRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.Header.Get("X-HTTP-Method-Override"))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		override    string
+		method, got string
+	}{
+		{`false`, "PATCH", "POST "},
+		{`true`, "PATCH", "POST PATCH"},
+		{`true`, "GET", "GET "},
+	} {
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "methodRewrite": {"PATCH": "POST"}, "methodOverrideHeader": `+tt.override+`}}}`)
+		if got := serveProxy(appRequest(tt.method, "/", nil)).Body.String(); got != tt.got {
+			t.Errorf("%s with methodOverrideHeader %s: backend got %q, want %q", tt.method, tt.override, got, tt.got)
+		}
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	backend, conns := countingBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Connection")))
+	})
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "maxRequestsPerConn": 2}}}`, backend.URL))
+
+	var closes int
+	for i := 0; i < 6; i++ {
+		if serveProxy(appRequest("GET", "/", nil)).Body.String() == "close" {
+			closes++
+		}
+	}
+	if got := conns.Load(); got != 3 || closes != 3 {
+		t.Errorf("6 requests used %d connections with %d Connection: close, want 3 and 3", got, closes)
+	}
+}
+
+// 接続は受け付けるが TLS のハンドシェイクに答えないバックエンド
+func silentListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return ln
+}
+
+func TestConnectAndTLSHandshakeTimeouts(t *testing.T) {
+	useConfig(t, `{}`)
+	if got := newDialer(Backend{ConnectTimeout: 250}, &Config{}).Timeout; got != 250*time.Millisecond {
+		t.Errorf("dialer timeout = %v, want 250ms", got)
+	}
+	if got := newDialer(Backend{}, &Config{}).Timeout; got != 30*time.Second {
+		t.Errorf("default dialer timeout = %v, want 30s", got)
+	}
+
+	ln := silentListener(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "https://`+ln.Addr().String()+`", "tlsHandshakeTimeout": 50}}}`)
+	start := time.Now()
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("handshake timeout took %v", elapsed)
+	}
+	if entries := logsWithMessage(t, "upstream error"); len(entries) != 1 || entries[0]["error_kind"] != "tls_handshake_timeout" {
+		t.Errorf("upstream error log = %v", entries)
+	}
+}
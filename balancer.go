@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// instances の各値。文字列だけを書いた場合は重み 1 の URL として扱う
+// weight は roundRobin では回ってくる回数、consistentHash ではリング上の仮想ノード数の比になる
+type Instance struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"` // 0 は 1 と同じ
+}
+
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	var rawURL string
+	if err := json.Unmarshal(data, &rawURL); err == nil {
+		*i = Instance{URL: rawURL}
+		return nil
+	}
+	type plain Instance
+	return json.Unmarshal(data, (*plain)(i))
+}
+
+// 重み付きのラウンドロビンの 1 周分 (nginx の smooth weighted round-robin)
+// 重い instance が続けて並ばないよう、重みに比例して散らばった順番を作る
+func weightedSchedule(instances []Instance) []int {
+	total := 0
+	for _, instance := range instances {
+		total += max(1, instance.Weight)
+	}
+	current := make([]int, len(instances))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, instance := range instances {
+			current[i] += max(1, instance.Weight)
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// 重み 1 あたりのリング上の仮想ノード数
+const hashRingReplicas = 100
+
+// インスタンスを増減しても付け替わるキーが少なくなるようにするハッシュリング
+type hashRing struct {
+	points []uint32
+	owners map[uint32]int
+}
+
+func newHashRing(instances []Instance) *hashRing {
+	ring := &hashRing{owners: map[uint32]int{}}
+	for i, instance := range instances {
+		for v := 0; v < hashRingReplicas*max(1, instance.Weight); v++ {
+			point := crc32.ChecksumIEEE([]byte(instance.URL + "#" + strconv.Itoa(v)))
+			if _, ok := ring.owners[point]; ok {
+				continue
+			}
+			ring.owners[point] = i
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(a, b int) bool { return ring.points[a] < ring.points[b] })
+	return ring
+}
+
+// キーの位置から時計回りに進み、usable なインスタンスを返す。なければ -1
+func (ring *hashRing) get(key string, usable func(int) bool) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	for k := 0; k < len(ring.points); k++ {
+		if owner := ring.owners[ring.points[(idx+k)%len(ring.points)]]; usable(owner) {
+			return owner
+		}
+	}
+	return -1
+}
+
+// hashKey: path (既定) / header:<名前> / cookie:<名前>
+func consistentHashKey(r *http.Request, hashKey string) string {
+	kind, name, _ := strings.Cut(hashKey, ":")
+	switch kind {
+	case "header":
+		return r.Header.Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	a, b := textBackend(t, "a"), textBackend(t, "b")
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"instances": [{"url": %q, "weight": 3}, %q]}}}`, a.URL, b.URL))
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[serveProxy(appRequest("GET", "/", nil)).Body.String()]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Errorf("got %v, want a:6 b:2", counts)
+	}
+}
+
+func TestWeightedSchedule(t *testing.T) {
+	schedule := weightedSchedule([]Instance{{Weight: 5}, {Weight: 1}, {Weight: 1}})
+	if fmt.Sprint(schedule) != "[0 0 1 0 2 0 0]" {
+		t.Errorf("schedule = %v", schedule)
+	}
+	// 重み 0 は 1 と同じ
+	if schedule := weightedSchedule([]Instance{{}, {}}); fmt.Sprint(schedule) != "[0 1]" {
+		t.Errorf("unweighted schedule = %v", schedule)
+	}
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"instances": [{"url": "http://127.0.0.1:1", "weight": -1}]}}}`)); err == nil {
+		t.Error("negative weight was accepted")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	a, b, c := textBackend(t, "a"), textBackend(t, "b"), textBackend(t, "c")
+	useConfig(t, fmt.Sprintf(`{"backends": {
+		"app.test": {"instances": [%q, %q, %q], "loadBalancing": "consistentHash"},
+		"user.test": {"instances": [%q, %q, %q], "loadBalancing": "consistentHash", "hashKey": "header:X-User"}
+	}}`, a.URL, b.URL, c.URL, a.URL, b.URL, c.URL))
+
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		path := fmt.Sprintf("/item/%d", i)
+		first := serveProxy(appRequest("GET", path, nil)).Body.String()
+		if again := serveProxy(appRequest("GET", path, nil)).Body.String(); again != first {
+			t.Errorf("%s went to %s then %s", path, first, again)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("30 paths used only %v", seen)
+	}
+
+	byUser := func(user, path string) string {
+		r := appRequest("GET", path, nil)
+		r.Host = "user.test"
+		r.Header.Set("X-User", user)
+		return serveProxy(r).Body.String()
+	}
+	if byUser("alice", "/a") != byUser("alice", "/b") {
+		t.Error("the same X-User went to different instances")
+	}
+}
+
+func TestConsistentHashSkipsUnhealthy(t *testing.T) {
+	ring := newHashRing([]Instance{{URL: "http://a"}, {URL: "http://b"}})
+	owner := ring.get("key", anyInstance)
+	other := ring.get("key", func(i int) bool { return i != owner })
+	if other == owner || other < 0 {
+		t.Errorf("got %d after excluding %d", other, owner)
+	}
+	if got := ring.get("key", func(int) bool { return false }); got != -1 {
+		t.Errorf("no usable instance: got %d", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"text/template"
+)
+
+const defaultRequestBodyTemplateMaxBytes = 1 << 20
+
+// requestBodyTemplate で使える関数。{{json .Body}} で値を JSON に戻す
+var bodyTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseRequestBodyTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("requestBody").Funcs(bodyTemplateFuncs).Parse(text)
+}
+
+// application/json のリクエスト本文を requestBodyTemplate で書き換える
+// テンプレートには .Body (パースした値) と .Raw (元の文字列) を渡す
+// JSON でないもの、上限を超えるもの、パースできないものはそのまま転送する
+func transformRequestBody(r *http.Request, tmpl *template.Template, maxBytes int) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" || r.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultRequestBodyTemplateMaxBytes
+	}
+	if r.ContentLength > int64(maxBytes) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var doc any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, map[string]any{"Body": doc, "Raw": string(body)}); err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(out.Bytes()))
+	r.ContentLength = int64(out.Len())
+	r.Header.Set("Content-Length", strconv.Itoa(out.Len()))
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocert が証明書を保存したタイミングで取得・更新のイベントを記録する
+type loggingCertCache struct {
+	autocert.Cache
+}
+
+func (c loggingCertCache) Put(ctx context.Context, key string, data []byte) error {
+	_, getErr := c.Cache.Get(ctx, key)
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+
+	cert := leafCertificate(data)
+	if cert == nil {
+		// アカウント鍵など証明書以外のデータ
+		return nil
+	}
+	domain := strings.TrimSuffix(key, "+rsa")
+	l, _ := certLookups.LoadOrStore(domain, new(certLookup))
+	l.(*certLookup).stored.Add(1)
+
+	event := "certificate_renewed"
+	if getErr != nil {
+		event = "certificate_obtained"
+	}
+	slog.Info("certificate stored",
+		slog.String("event", event),
+		slog.String("domain", domain),
+		slog.Time("not_after", cert.NotAfter),
+	)
+	return nil
+}
+
+// ドメインごとに autocert が証明書を保存した回数
+// autocert は Cache にハンドシェイクのコンテキストを渡さないので、GetCertificate の前後で比べて見分ける
+// 保存されるのは HostPolicy を通ったドメインだけなので、知らない SNI が来ても増えない
+type certLookup struct {
+	stored  atomic.Int64
+	claimed atomic.Int64 // ハンドシェイクの取得として数え終えた stored の値
+}
+
+var certLookups sync.Map // ドメイン -> *certLookup
+
+func certStoredCount(domain string) int64 {
+	if l, ok := certLookups.Load(domain); ok {
+		return l.(*certLookup).stored.Load()
+	}
+	return 0
+}
+
+// autocert の GetCertificate を呼び、キャッシュ (メモリかディスク) から返したか新しく取得したかを記録する
+// 取得は時間がかかるので、ロックは持たずに呼び出しの前後の保存回数を比べる
+func getCertificateCounted(manager *autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, string, error) {
+	domain := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	before := certStoredCount(domain)
+	cert, err := manager.GetCertificate(hello)
+	if err != nil {
+		return nil, "", err
+	}
+	if l, ok := certLookups.Load(domain); ok {
+		lookup := l.(*certLookup)
+		// 同じ取得を待っていた他のハンドシェイクは、最初に数えた 1 つのほかはキャッシュから返したものとする
+		if after := lookup.stored.Load(); after != before && lookup.claimed.Swap(after) != after {
+			certAcquisitions.Add(1)
+			return cert, "acquired", nil
+		}
+	}
+	certCacheHits.Add(1)
+	return cert, "cache", nil
+}
+
+// 保存データ (秘密鍵 + 証明書チェーンの PEM) から最初の証明書を取り出す
+func leafCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		return cert
+	}
+}
+
+var defaultCertExpiryWarnDays = []int{30, 14, 7}
+
+// 静的な証明書の有効期限。/_/status で返す
+type certExpiry struct {
+	mu       sync.Mutex
+	path     string
+	notAfter time.Time
+	warned   map[int]bool // 警告済みのしきい値 (日)
+}
+
+var staticCertExpiry = &certExpiry{warned: map[int]bool{}}
+
+// sslCertPath の証明書は自動で更新されないので、期限が近づいたら warn で知らせる
+// ファイルが差し替えられても分かるよう、毎回読み直す
+func watchCertExpiry(path string) {
+	for {
+		staticCertExpiry.check(path, time.Now())
+		time.Sleep(time.Hour)
+	}
+}
+
+func (c *certExpiry) check(path string, now time.Time) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("cannot read certificate for expiry check", slog.String("path", path), slog.String("error", err.Error()))
+		return
+	}
+	cert := leafCertificate(data)
+	if cert == nil {
+		slog.Warn("no certificate found for expiry check", slog.String("path", path))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !cert.NotAfter.Equal(c.notAfter) {
+		// 新しい証明書に替わったら警告をやり直す
+		c.warned = map[int]bool{}
+	}
+	c.path = path
+	c.notAfter = cert.NotAfter
+
+	thresholds := config.CertExpiryWarnDays
+	if len(thresholds) == 0 {
+		thresholds = defaultCertExpiryWarnDays
+	}
+	thresholds = append([]int(nil), thresholds...)
+	sort.Ints(thresholds)
+	days := daysUntil(cert.NotAfter, now)
+	// 一番近いしきい値で 1 度だけ警告する
+	for _, threshold := range thresholds {
+		if days > threshold {
+			continue
+		}
+		if !c.warned[threshold] {
+			c.warned[threshold] = true
+			slog.Warn("certificate expires soon",
+				slog.String("path", path),
+				slog.Time("not_after", cert.NotAfter),
+				slog.Int("days_to_expiry", days),
+				slog.Int("threshold_days", threshold),
+			)
+		}
+		break
+	}
+}
+
+func (c *certExpiry) status(now time.Time) map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notAfter.IsZero() {
+		return nil
+	}
+	return map[string]any{
+		"path":           c.path,
+		"not_after":      c.notAfter,
+		"days_to_expiry": daysUntil(c.notAfter, now),
+	}
+}
+
+func daysUntil(t, now time.Time) int {
+	return int(t.Sub(now).Hours() / 24)
+}
+
+// GET /_/status
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	status := map[string]any{
+		"boot_id":  bootID,
+		"uptime":   int(now.Sub(startedAt).Seconds()),
+		"draining": draining.Load(),
+	}
+	if cert := staticCertExpiry.status(now); cert != nil {
+		status["certificate"] = cert
+	}
+	writeJSON(w, status)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ログのうち msg が一致する行
+func logsWithMessage(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	var found []map[string]any
+	for _, entry := range logEntries(t) {
+		if entry["msg"] == msg {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+func TestCertificateStoredEvents(t *testing.T) {
+	testLog.Reset()
+	cache := loggingCertCache{autocert.DirCache(t.TempDir())}
+	ctx := context.Background()
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	_, certPEM, keyPEM := selfSignedCert(t, "app.test", notAfter, x509.ExtKeyUsageServerAuth)
+	// autocert は秘密鍵と証明書チェーンを続けて保存する
+	data := append(keyPEM, certPEM...)
+
+	cache.Put(ctx, "app.test", data)
+	cache.Put(ctx, "app.test", data)
+	cache.Put(ctx, "acme_account+key", keyPEM)
+
+	events := logsWithMessage(t, "certificate stored")
+	if len(events) != 2 {
+		t.Fatalf("got %d certificate events, want 2: %v", len(events), events)
+	}
+	if events[0]["event"] != "certificate_obtained" || events[1]["event"] != "certificate_renewed" {
+		t.Errorf("events = %v, %v", events[0]["event"], events[1]["event"])
+	}
+	if events[0]["domain"] != "app.test" || events[0]["not_after"] != notAfter.Format(time.RFC3339) {
+		t.Errorf("event = %v", events[0])
+	}
+}
+
+func TestCertExpiryWarnings(t *testing.T) {
+	useConfig(t, `{}`)
+	now := time.Now()
+	_, certPEM, _ := selfSignedCert(t, "app.test", now.Add(10*24*time.Hour+time.Hour), x509.ExtKeyUsageServerAuth)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	os.WriteFile(path, certPEM, 0644)
+
+	expiry := &certExpiry{warned: map[int]bool{}}
+	warnings := func() []float64 {
+		var thresholds []float64
+		for _, entry := range logsWithMessage(t, "certificate expires soon") {
+			thresholds = append(thresholds, entry["threshold_days"].(float64))
+		}
+		return thresholds
+	}
+	expiry.check(path, now)
+	expiry.check(path, now.Add(time.Hour))
+	if got := fmt.Sprint(warnings()); got != "[14]" {
+		t.Errorf("10 days before expiry: warned at %s, want once at 14", got)
+	}
+	expiry.check(path, now.Add(4*24*time.Hour))
+	if got := fmt.Sprint(warnings()); got != "[14 7]" {
+		t.Errorf("6 days before expiry: warned at %s", got)
+	}
+
+	// 新しい証明書に替わったら数え直す
+	_, renewedPEM, _ := selfSignedCert(t, "app.test", now.Add(5*24*time.Hour+time.Hour), x509.ExtKeyUsageServerAuth)
+	os.WriteFile(path, renewedPEM, 0644)
+	testLog.Reset()
+	expiry.check(path, now)
+	if got := fmt.Sprint(warnings()); got != "[7]" {
+		t.Errorf("after replacing the certificate: warned at %s", got)
+	}
+}
+
+func TestStatusReportsCertificate(t *testing.T) {
+	useConfig(t, `{"certExpiryWarnDays": [3]}`)
+	_, certPEM, _ := selfSignedCert(t, "app.test", time.Now().Add(20*24*time.Hour+time.Hour), x509.ExtKeyUsageServerAuth)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	os.WriteFile(path, certPEM, 0644)
+	prev := staticCertExpiry
+	staticCertExpiry = &certExpiry{warned: map[int]bool{}}
+	t.Cleanup(func() { staticCertExpiry = prev })
+	staticCertExpiry.check(path, time.Now())
+
+	rec := httptest.NewRecorder()
+	handleStatus(rec, httptest.NewRequest("GET", "/_/status", nil))
+	var status struct {
+		BootID      string `json:"boot_id"`
+		Certificate struct {
+			Path         string `json:"path"`
+			DaysToExpiry int    `json:"days_to_expiry"`
+		} `json:"certificate"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.BootID != bootID || status.Certificate.Path != path || status.Certificate.DaysToExpiry != 20 {
+		t.Errorf("status = %s", rec.Body.String())
+	}
+	if len(logsWithMessage(t, "certificate expires soon")) != 0 {
+		t.Error("warned before the configured threshold")
+	}
+}
+
+func TestCertCacheCountsStores(t *testing.T) {
+	cache := loggingCertCache{autocert.DirCache(t.TempDir())}
+	ctx := context.Background()
+	_, certPEM, keyPEM := selfSignedCert(t, "store.test", time.Now().Add(90*24*time.Hour), x509.ExtKeyUsageServerAuth)
+
+	cache.Put(ctx, "store.test", append(keyPEM, certPEM...))
+	cache.Put(ctx, "store.test+rsa", append(keyPEM, certPEM...))
+	// アカウント鍵など証明書でないものは数えない
+	cache.Put(ctx, "acme_account+key", keyPEM)
+	if got := certStoredCount("store.test"); got != 2 {
+		t.Errorf("stored = %d, want 2", got)
+	}
+	if _, ok := certLookups.Load("acme_account+key"); ok {
+		t.Error("account key was counted as a certificate")
+	}
+
+	// キャッシュを引いただけのドメインは覚えない
+	cache.Get(ctx, "unknown.test")
+	if _, ok := certLookups.Load("unknown.test"); ok {
+		t.Error("a cache miss added an entry")
+	}
+}
+
+func TestGetCertificateCounted(t *testing.T) {
+	dir := autocert.DirCache(t.TempDir())
+	_, certPEM, keyPEM := selfSignedCert(t, "app.test", time.Now().Add(90*24*time.Hour), x509.ExtKeyUsageServerAuth)
+	dir.Put(context.Background(), "app.test", append(keyPEM, certPEM...))
+	manager := &autocert.Manager{
+		Cache:      loggingCertCache{dir},
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist("app.test"),
+	}
+	// ECDSA の証明書を受け取れるクライアント
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "app.test",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+	hits, acquisitions := certCacheHits.Load(), certAcquisitions.Load()
+
+	for i := 0; i < 2; i++ {
+		cert, source, err := getCertificateCounted(manager, hello)
+		if err != nil || cert == nil || source != "cache" {
+			t.Fatalf("request %d: source %q, err %v", i, source, err)
+		}
+	}
+	if got := certCacheHits.Load() - hits; got != 2 {
+		t.Errorf("cache hits = %d, want 2", got)
+	}
+
+	// キャッシュにないドメインは取得を試みる前に HostPolicy で断られ、どちらにも数えない
+	other := *hello
+	other.ServerName = "other.test"
+	if _, _, err := getCertificateCounted(manager, &other); err == nil {
+		t.Error("certificate for a host outside HostPolicy was returned")
+	}
+	if certCacheHits.Load()-hits != 2 || certAcquisitions.Load() != acquisitions {
+		t.Errorf("hits %d, acquisitions %d after a failed lookup", certCacheHits.Load()-hits, certAcquisitions.Load()-acquisitions)
+	}
+	if _, ok := certLookups.Load("other.test"); ok {
+		t.Error("a host outside HostPolicy added an entry")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// chaosEnabled が false の間は injectLatency も injectError も何もしない
+
+// 障害試験用に転送前に入れる遅延 (ミリ秒)。max が min 以下なら min だけ待つ
+type LatencyInjection struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (l *LatencyInjection) duration() time.Duration {
+	ms := l.Min
+	if l.Max > l.Min {
+		ms += rand.Intn(l.Max - l.Min + 1)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// 待っている間にクライアントが切断したら false を返す
+func injectLatency(r *http.Request, l *LatencyInjection) bool {
+	if !config.ChaosEnabled || l == nil {
+		return true
+	}
+	timer := time.NewTimer(l.duration())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// 障害試験用に、probability (0〜1) の割合でバックエンドに送らず status を返す
+type ErrorInjection struct {
+	Status      int     `json:"status"`
+	Probability float64 `json:"probability"`
+}
+
+// エラーを返したら true を返す
+func injectError(w http.ResponseWriter, r *http.Request, e *ErrorInjection) bool {
+	if !config.ChaosEnabled || e == nil || rand.Float64() >= e.Probability {
+		return false
+	}
+	if ut, ok := r.Context().Value(upstreamTraceKey{}).(*upstreamTrace); ok {
+		ut.faultInjected = true
+	}
+	log.Printf("Injected fault: status %d for %s %s", e.Status, r.Host, r.URL.Path)
+	http.Error(w, http.StatusText(e.Status), e.Status)
+	return true
+}
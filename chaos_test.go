@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLatencyInjectionDuration(t *testing.T) {
+	l := &LatencyInjection{Min: 10, Max: 20}
+	for i := 0; i < 100; i++ {
+		if d := l.duration(); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("duration = %v, want 10ms..20ms", d)
+		}
+	}
+	if d := (&LatencyInjection{Min: 30, Max: 5}).duration(); d != 30*time.Millisecond {
+		t.Errorf("max below min: duration = %v, want 30ms", d)
+	}
+}
+
+func TestInjectLatency(t *testing.T) {
+	backend := textBackend(t, "ok")
+	for _, tt := range []struct {
+		chaos bool
+		slow  bool
+	}{
+		{true, true},
+		// chaosEnabled でなければ待たない
+		{false, false},
+	} {
+		useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "injectLatency": {"min": 100}}}, "chaosEnabled": %t}`, backend.URL, tt.chaos))
+		start := time.Now()
+		rec := serveProxy(appRequest("GET", "/", nil))
+		if elapsed := time.Since(start); (elapsed >= 100*time.Millisecond) != tt.slow || rec.Body.String() != "ok" {
+			t.Errorf("chaosEnabled %v: took %v, got %d %q", tt.chaos, elapsed, rec.Code, rec.Body.String())
+		}
+	}
+
+	// 待っている間にクライアントが切断したらすぐにやめる
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	useConfig(t, `{"chaosEnabled": true}`)
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	start := time.Now()
+	if injectLatency(r, &LatencyInjection{Min: 5000}) {
+		t.Error("injectLatency returned true for a canceled request")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("injectLatency kept waiting for %v after the client left", elapsed)
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	backend, conns := countingBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "injectError": {"status": 503, "probability": 1}}}, "chaosEnabled": true}`, backend.URL))
+
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", rec.Code)
+	}
+	if conns.Load() != 0 {
+		t.Error("injected error still reached the backend")
+	}
+	if entry := lastAccessLog(t); entry["outcome"] != "fault_injected" {
+		t.Errorf("outcome = %v", entry["outcome"])
+	}
+
+	// chaosEnabled でないときや probability が 0 のときは返さない
+	for _, tt := range []struct {
+		chaos       bool
+		probability float64
+	}{
+		{false, 1},
+		{true, 0},
+	} {
+		useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "injectError": {"status": 503, "probability": %g}}}, "chaosEnabled": %t}`, backend.URL, tt.probability, tt.chaos))
+		if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+			t.Errorf("chaosEnabled %v, probability %g: got %d", tt.chaos, tt.probability, rec.Code)
+		}
+	}
+}
+
+func TestInjectErrorValidation(t *testing.T) {
+	for _, injection := range []string{
+		`{"status": 200, "probability": 0.5}`,
+		`{"status": 503, "probability": 1.5}`,
+		`{"status": 503, "probability": -0.1}`,
+	} {
+		if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "injectError": ` + injection + `}}}`)); err == nil {
+			t.Errorf("injectError %s was accepted", injection)
+		}
+	}
+}
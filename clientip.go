@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 本当のクライアントの IP を返す
+// trustedProxyHops 台の信頼できるプロキシを経由している場合、X-Forwarded-For と接続元をつないだ列の
+// 右から trustedProxyHops+1 番目がクライアントになる
+// X-Forwarded-For は誰でも付けられるので、接続元が trustedProxyCIDRs の範囲にあるときだけ信じる
+// 列が短くて左端 (クライアントが書いた値) まで届くときも接続元を使う
+func clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if config.TrustedProxyHops <= 0 || !trustedProxy(peer) {
+		return peer
+	}
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	chain = append(chain, peer)
+	i := len(chain) - 1 - config.TrustedProxyHops
+	if i < 0 {
+		return peer
+	}
+	return chain[i]
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, cidr := range config.TrustedProxyCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		config, remoteAddr string
+		xff                []string
+		want               string
+	}{
+		{`{}`, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		// 接続元が trustedProxyCIDRs になければ X-Forwarded-For は見ない
+		{`{"trustedProxyHops": 1}`, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{`{"trustedProxyHops": 1, "trustedProxyCIDRs": ["10.0.0.0/8"]}`, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{`{"trustedProxyHops": 1, "trustedProxyCIDRs": ["10.0.0.0/8"]}`, "10.0.0.5:1234", []string{"198.51.100.1, 203.0.113.9"}, "203.0.113.9"},
+		// 複数の X-Forwarded-For ヘッダーもつないで数える
+		{`{"trustedProxyHops": 2, "trustedProxyCIDRs": ["10.0.0.0/8"]}`, "10.0.0.5:1234", []string{"198.51.100.1", "203.0.113.9, 10.0.0.6"}, "203.0.113.9"},
+		// 列が短ければクライアントが書いた左端ではなく接続元を使う
+		{`{"trustedProxyHops": 2, "trustedProxyCIDRs": ["10.0.0.0/8"]}`, "10.0.0.5:1234", []string{"203.0.113.9"}, "10.0.0.5"},
+	} {
+		useConfig(t, tt.config)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s from %s with %q: clientIP = %s, want %s", tt.config, tt.remoteAddr, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestAdminIgnoresTrustedForwardedFor(t *testing.T) {
+	useConfig(t, `{"adminToken": "secret", "adminAllowedCIDRs": ["10.0.0.0/8"], "trustedProxyHops": 1, "trustedProxyCIDRs": ["192.0.2.0/24"]}`)
+	r := adminRequest("GET", "/_/maintenance")
+	r.RemoteAddr = "192.0.2.1:5000"
+	r.Header.Set("X-Forwarded-For", "10.1.2.3")
+	rec := httptest.NewRecorder()
+	requireAdmin(handleMaintenance)(rec, r)
+	if rec.Code != http.StatusUnauthorized {
+		t.Error("admin endpoint trusted the client IP from X-Forwarded-For")
+	}
+}
+
+func TestClientIPInAccessLog(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "trustedProxyHops": 1, "trustedProxyCIDRs": ["192.0.2.0/24"]}`)
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	serveProxy(r)
+	if entry := lastAccessLog(t); entry["client_ip"] != "203.0.113.9" {
+		t.Errorf("client_ip = %v", entry["client_ip"])
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// coalesceRequests や idempotencyKeyTTL で写しを取るレスポンス本文の上限
+// 超えたら共有も保存もせず、待っていたリクエストはそれぞれ送り直す
+const maxCoalescedBodyBytes = 1 << 20
+
+// 同じリクエストが同時に来たら、最初の 1 つだけをバックエンドに送って残りに結果を配る
+type coalescer struct {
+	apiKeyHeader string // apiKeyHeader のルートでは API キーごとに分ける
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	shared bool // false なら待っていた側は自分で送る
+	status int
+	header http.Header
+	body   []byte
+}
+
+// 認証やクッキーで内容が変わるものは混ぜない
+func coalescable(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		r.Header.Get("Authorization") == "" &&
+		r.Header.Get("Cookie") == "" &&
+		r.Header.Get("Range") == "" &&
+		!isWebSocketUpgrade(r)
+}
+
+// Vary がこれ以外のヘッダーを挙げていたら、結果は分け合わない
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+func (c *coalescer) key(r *http.Request) string {
+	parts := []string{r.Host, r.URL.RequestURI()}
+	for _, name := range coalesceKeyHeaders {
+		parts = append(parts, r.Header.Get(name))
+	}
+	if c.apiKeyHeader != "" {
+		parts = append(parts, r.Header.Get(c.apiKeyHeader))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (c *coalescer) serve(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc) {
+	key := c.key(r)
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if !call.shared {
+			forward(w, r)
+			return
+		}
+		for name, values := range call.header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		w.WriteHeader(call.status)
+		w.Write(call.body)
+		return
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// 途中で panic (ErrAbortHandler) したときや切断されたときは、壊れたレスポンスを配らない
+	rec := &coalesceRecorder{ResponseWriter: w, before: w.Header().Clone()}
+	completed := false
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.shared = completed && r.Context().Err() == nil && rec.shareable()
+		call.status, call.header, call.body = rec.status, rec.header, rec.body.Bytes()
+		close(call.done)
+	}()
+	forward(rec, r)
+	completed = true
+}
+
+// 最初のリクエストのレスポンスをそのまま返しながら写しを取る
+// user_uuid のクッキーなど、転送前にプロキシが付けたヘッダーはそのクライアントのものなので写さない
+type coalesceRecorder struct {
+	http.ResponseWriter
+	before   http.Header
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *coalesceRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+		rec.header = http.Header{}
+		for name, values := range rec.ResponseWriter.Header() {
+			if !slices.Equal(values, rec.before[name]) {
+				rec.header[name] = slices.Clone(values)
+			}
+		}
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *coalesceRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > maxCoalescedBodyBytes {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// 他のクライアントに見せてはいけないレスポンスは配らない
+func (rec *coalesceRecorder) shareable() bool {
+	if rec.status == 0 || rec.overflow || rec.header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, v := range rec.header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if !containsHeaderName(coalesceKeyHeaders, strings.TrimSpace(name)) {
+				return false
+			}
+		}
+	}
+	cacheControl := strings.ToLower(rec.header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "private") && !strings.Contains(cacheControl, "no-store")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// release を閉じるまでレスポンスを返さないバックエンド
+func blockingBackend(t *testing.T, header http.Header) (*httptest.Server, *atomic.Int64, chan struct{}) {
+	t.Helper()
+	var hits atomic.Int64
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Write([]byte("shared body"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &hits, release
+}
+
+// 最初のリクエストがバックエンドに届いてから残りを送り、そろったところでレスポンスを返させる
+func serveConcurrently(t *testing.T, hits *atomic.Int64, release chan struct{}, requests []*http.Request) []*httptest.ResponseRecorder {
+	t.Helper()
+	recs := make([]*httptest.ResponseRecorder, len(requests))
+	var wg sync.WaitGroup
+	for i, r := range requests {
+		wg.Add(1)
+		go func(i int, r *http.Request) {
+			defer wg.Done()
+			recs[i] = serveProxy(r)
+		}(i, r)
+		if i == 0 {
+			for hits.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return recs
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	backend, hits, release := blockingBackend(t, http.Header{"Cache-Control": {"max-age=60"}})
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "coalesceRequests": true}}}`)
+
+	var requests []*http.Request
+	for i := 0; i < 5; i++ {
+		requests = append(requests, appRequest("GET", "/feed", nil))
+	}
+	for i, rec := range serveConcurrently(t, hits, release, requests) {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared body" {
+			t.Errorf("request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("backend was hit %d times, want 1", got)
+	}
+}
+
+func TestCoalesceRequestsDoesNotShare(t *testing.T) {
+	t.Run("different API keys", func(t *testing.T) {
+		backend, hits, release := blockingBackend(t, nil)
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "coalesceRequests": true, "apiKeyHeader": "X-Api-Key", "apiKeyHashes": ["`+sha256Hex("key-a")+`", "`+sha256Hex("key-b")+`"]}}}`)
+		a, b := appRequest("GET", "/feed", nil), appRequest("GET", "/feed", nil)
+		a.Header.Set("X-Api-Key", "key-a")
+		b.Header.Set("X-Api-Key", "key-b")
+		serveConcurrently(t, hits, release, []*http.Request{a, b})
+		if got := hits.Load(); got != 2 {
+			t.Errorf("backend was hit %d times, want 2", got)
+		}
+	})
+
+	t.Run("Vary: Cookie", func(t *testing.T) {
+		backend, hits, release := blockingBackend(t, http.Header{"Vary": {"Accept-Encoding, Cookie"}})
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "coalesceRequests": true}}}`)
+		serveConcurrently(t, hits, release, []*http.Request{appRequest("GET", "/feed", nil), appRequest("GET", "/feed", nil)})
+		if got := hits.Load(); got != 2 {
+			t.Errorf("backend was hit %d times, want 2", got)
+		}
+	})
+
+	t.Run("Authorization", func(t *testing.T) {
+		backend, hits, release := blockingBackend(t, nil)
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "coalesceRequests": true}}}`)
+		a, b := appRequest("GET", "/feed", nil), appRequest("GET", "/feed", nil)
+		a.Header.Set("Authorization", "Bearer a")
+		b.Header.Set("Authorization", "Bearer a")
+		serveConcurrently(t, hits, release, []*http.Request{a, b})
+		if got := hits.Load(); got != 2 {
+			t.Errorf("backend was hit %d times, want 2", got)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// encoding/json は重複したキーを黙って後勝ちにするので、読み込む前に探す
+// 見つかったキーを "backends.example.com" のようなパスで返す
+func duplicateJSONKeys(data []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var duplicates []string
+	if err := walkJSONValue(decoder, "", &duplicates); err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+func walkJSONValue(decoder *json.Decoder, path string, duplicates *[]string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		seen := map[string]bool{}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key := keyToken.(string)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if seen[key] {
+				*duplicates = append(*duplicates, keyPath)
+			}
+			seen[key] = true
+			if err := walkJSONValue(decoder, keyPath, duplicates); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			if err := walkJSONValue(decoder, fmt.Sprintf("%s[%d]", path, i), duplicates); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	}
+	return nil
+}
+
+func checkDuplicateJSONKeys(data []byte) error {
+	duplicates, err := duplicateJSONKeys(data)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("duplicate keys in config: %s", strings.Join(duplicates, ", "))
+	}
+	return nil
+}
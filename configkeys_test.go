@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateJSONKeys(t *testing.T) {
+	duplicates, err := duplicateJSONKeys([]byte(`{
+		"port": 443,
+		"backends": {"a.test": "http://127.0.0.1:1", "a.test": "http://127.0.0.1:2"},
+		"pathRules": [{"action": "allow", "action": "deny"}],
+		"port": 8443
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(duplicates); got != "[backends.a.test pathRules[0].action port]" {
+		t.Errorf("duplicates = %s", got)
+	}
+}
+
+func TestConfigWithDuplicateKeysIsRejected(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+
+	err := applyConfigJson([]byte(`{"backends": {"app.test": "http://127.0.0.1:1", "app.test": "` + backend.URL + `"}}`))
+	if err == nil || !strings.Contains(err.Error(), "backends.app.test") {
+		t.Fatalf("err = %v", err)
+	}
+	// 同じ名前でも別のオブジェクトの中なら重複ではない
+	if err := applyConfigJson([]byte(`{"backends": {"a.test": {"url": "` + backend.URL + `"}, "b.test": {"url": "` + backend.URL + `"}}}`)); err != nil {
+		t.Errorf("keys in different objects: %v", err)
+	}
+}
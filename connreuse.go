@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// maxRequestsPerConn: この数のリクエストを送った接続は使い終わったら閉じる
+// バックエンドを増やしたときなどに、接続を張り直させて偏りをならす
+type connReuseLimit struct {
+	http.RoundTripper
+	max int64
+}
+
+// 接続ごとに送ったリクエストの数を数える
+type countedConn struct {
+	net.Conn
+	requests atomic.Int64
+}
+
+func countConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+func (t connReuseLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	var outreq *http.Request
+	trace := &httptrace.ClientTrace{
+		// 接続が決まってから書き込むまでの間に呼ばれるので、ここで Close を立てれば
+		// Connection: close を付けて送り、レスポンスの後に接続を閉じてくれる
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			if cc, ok := conn.(*countedConn); ok && cc.requests.Add(1) >= t.max {
+				outreq.Close = true
+			}
+		},
+	}
+	outreq = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.RoundTripper.RoundTrip(outreq)
+}
+
+func (t connReuseLimit) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
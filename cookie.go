@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	uuidCookieName       = "user_uuid"
+	uuidIssuedCookieName = "user_uuid_issued"
+	uuidPrevCookieName   = "user_uuid_prev"
+)
+
+// クッキーからUUIDを取得、なければ新しいUUIDを生成して設定
+// uuidCookieRotateAfter を過ぎたUUIDは作り直し、古い値を返す
+func userUUID(w http.ResponseWriter, r *http.Request) (string, string) {
+	now := time.Now()
+	uuidCookie, err := r.Cookie(uuidCookieName)
+	if err != nil {
+		newUUID := uuid.New().String()
+		setUUIDCookies(w, newUUID, now)
+		return newUUID, ""
+	}
+	if config.UUIDCookieRotateAfter <= 0 {
+		return uuidCookie.Value, ""
+	}
+
+	// 発行時刻がない既存のクッキーは今から数える
+	issuedCookie, err := r.Cookie(uuidIssuedCookieName)
+	if err != nil {
+		setUUIDCookies(w, uuidCookie.Value, now)
+		return uuidCookie.Value, ""
+	}
+	issuedAt, err := strconv.ParseInt(issuedCookie.Value, 10, 64)
+	if err != nil || now.Sub(time.Unix(issuedAt, 0)) < time.Duration(config.UUIDCookieRotateAfter)*time.Second {
+		return uuidCookie.Value, ""
+	}
+
+	// 切り替え直後もバックエンドが旧UUIDを引けるよう、猶予期間だけ残しておく
+	newUUID := uuid.New().String()
+	setUUIDCookies(w, newUUID, now)
+	if config.UUIDCookieRotationGrace > 0 {
+		http.SetCookie(w, &http.Cookie{
+			Name:   uuidPrevCookieName,
+			Value:  uuidCookie.Value,
+			Path:   "/",
+			MaxAge: config.UUIDCookieRotationGrace,
+		})
+	}
+	return newUUID, uuidCookie.Value
+}
+
+func setUUIDCookies(w http.ResponseWriter, value string, issuedAt time.Time) {
+	http.SetCookie(w, &http.Cookie{Name: uuidCookieName, Value: value, Path: "/", MaxAge: config.UUIDCookieMaxAge})
+	if config.UUIDCookieRotateAfter > 0 {
+		http.SetCookie(w, &http.Cookie{
+			Name:   uuidIssuedCookieName,
+			Value:  strconv.FormatInt(issuedAt.Unix(), 10),
+			Path:   "/",
+			MaxAge: config.UUIDCookieMaxAge,
+		})
+	}
+}
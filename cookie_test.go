@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func responseCookies(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	return cookies
+}
+
+func TestUserUUIDMaxAge(t *testing.T) {
+	useConfig(t, `{"uuidCookieMaxAge": 3600}`)
+	rec := httptest.NewRecorder()
+	id, rotatedFrom := userUUID(rec, httptest.NewRequest("GET", "/", nil))
+	cookie := responseCookies(rec)[uuidCookieName]
+	if cookie == nil || cookie.Value != id || cookie.MaxAge != 3600 || rotatedFrom != "" {
+		t.Errorf("cookie = %v, id %q, rotatedFrom %q", cookie, id, rotatedFrom)
+	}
+}
+
+func TestUserUUIDRotation(t *testing.T) {
+	useConfig(t, `{"uuidCookieRotateAfter": 60, "uuidCookieRotationGrace": 30}`)
+
+	fresh := httptest.NewRequest("GET", "/", nil)
+	fresh.AddCookie(&http.Cookie{Name: uuidCookieName, Value: "old"})
+	fresh.AddCookie(&http.Cookie{Name: uuidIssuedCookieName, Value: strconv.FormatInt(time.Now().Unix(), 10)})
+	rec := httptest.NewRecorder()
+	if id, rotatedFrom := userUUID(rec, fresh); id != "old" || rotatedFrom != "" {
+		t.Errorf("fresh cookie: got %q rotated from %q", id, rotatedFrom)
+	}
+
+	expired := httptest.NewRequest("GET", "/", nil)
+	expired.AddCookie(&http.Cookie{Name: uuidCookieName, Value: "old"})
+	expired.AddCookie(&http.Cookie{Name: uuidIssuedCookieName, Value: strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)})
+	rec = httptest.NewRecorder()
+	id, rotatedFrom := userUUID(rec, expired)
+	if id == "old" || rotatedFrom != "old" {
+		t.Fatalf("expired cookie: got %q rotated from %q", id, rotatedFrom)
+	}
+	cookies := responseCookies(rec)
+	if cookies[uuidCookieName].Value != id {
+		t.Errorf("new cookie = %v", cookies[uuidCookieName])
+	}
+	if prev := cookies[uuidPrevCookieName]; prev == nil || prev.Value != "old" || prev.MaxAge != 30 {
+		t.Errorf("previous cookie = %v", prev)
+	}
+}
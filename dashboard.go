@@ -0,0 +1,76 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>tiny_proxy</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px}.down{color:#c00}</style>
+</head>
+<body>
+<h1>tiny_proxy</h1>
+<section id="summary">
+<h2>Summary</h2>
+<p>boot_id {{.BootID}} / uptime {{.Uptime}} / {{printf "%.1f" .RPS}} req/s (last {{.Window}}s){{if .Draining}} / draining{{end}}</p>
+</section>
+<section id="backends">
+<h2>Backends</h2>
+<table>
+<tr><th>backend</th><th>req/s</th><th>5xx (last {{.Window}}s)</th><th>instances</th><th>maintenance</th></tr>
+{{range .Backends}}<tr><td>{{.Key}}</td><td>{{printf "%.1f" .RPS}}</td><td>{{.Errors}}</td><td>{{range .Instances}}<div{{if not .Healthy}} class="down"{{end}}>{{.URL}} {{if .Healthy}}up{{else}}down{{end}}</div>{{end}}</td><td>{{.Maintenance}}</td></tr>
+{{end}}</table>
+</section>
+</body>
+</html>
+`))
+
+type dashboardInstance struct {
+	URL     string
+	Healthy bool
+}
+
+type dashboardBackend struct {
+	Key         string
+	RPS         float64
+	Errors      int64
+	Instances   []dashboardInstance
+	Maintenance bool
+}
+
+// GET /_/dashboard
+// 直近のリクエスト数とバックエンドの状態を 5 秒ごとに更新される HTML で見せる
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var backends []dashboardBackend
+	for key, rt := range routes {
+		b := dashboardBackend{
+			Key:         key,
+			RPS:         float64(rt.requests.sum(now)) / statsWindow,
+			Errors:      rt.errors.sum(now),
+			Maintenance: rt.maintenance.Load(),
+		}
+		for i, instance := range rt.instances {
+			b.Instances = append(b.Instances, dashboardInstance{URL: instance.URL, Healthy: rt.healthy(i)})
+		}
+		backends = append(backends, b)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Key < backends[j].Key })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboardTemplate.Execute(w, map[string]any{
+		"BootID":   bootID,
+		"Uptime":   now.Sub(startedAt).Truncate(time.Second),
+		"RPS":      float64(allRequests.sum(now)) / statsWindow,
+		"Window":   statsWindow,
+		"Draining": draining.Load(),
+		"Backends": backends,
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	now := time.Unix(1700000000, 0)
+	w.add(now.Add(-statsWindow * time.Second)) // 窓の外
+	w.add(now.Add(-10 * time.Second))
+	w.add(now)
+	w.add(now)
+	if got := w.sum(now); got != 3 {
+		t.Errorf("sum = %d, want 3", got)
+	}
+	// 同じバケットを 1 周後の秒が使うと古い数は消える
+	w.add(now.Add(statsWindow * time.Second))
+	if got := w.sum(now.Add(statsWindow * time.Second)); got != 1 {
+		t.Errorf("sum after a full window = %d, want 1", got)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	ok := textBackend(t, "ok")
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	useConfig(t, `{"backends": {"app.test": "`+ok.URL+`", "failing.test": "`+failing.URL+`"}}`)
+
+	serveProxy(appRequest("GET", "/", nil))
+	for i := 0; i < 2; i++ {
+		r := appRequest("GET", "/", nil)
+		r.Host = "failing.test"
+		serveProxy(r)
+	}
+
+	rec := httptest.NewRecorder()
+	handleDashboard(rec, httptest.NewRequest("GET", "/_/dashboard", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"boot_id " + bootID,
+		"<tr><td>app.test</td><td>0.0</td><td>0</td><td><div>" + ok.URL + " up</div></td><td>false</td></tr>",
+		"<tr><td>failing.test</td><td>0.0</td><td>2</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard does not contain %q:\n%s", want, body)
+		}
+	}
+}
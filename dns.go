@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// バックエンドのホスト名の名前解決結果を dnsCacheTTL の間だけ使い回す
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+	lookup  func(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsEntry struct {
+	addrs     []string
+	expiresAt time.Time
+}
+
+var backendDNS = &dnsCache{
+	entries: map[string]dnsEntry{},
+	lookup: func(ctx context.Context, host string) ([]string, error) {
+		return backendResolver(config.ResolverAddress).LookupHost(ctx, host)
+	},
+}
+
+// resolverAddress があれば、システムのリゾルバーの代わりにその DNS サーバーへ問い合わせる
+func backendResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: 5 * time.Second}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expiresAt: time.Now().Add(time.Duration(config.DNSCacheTTL) * time.Second)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		// どのアドレスにもつながらなければ次の接続で引き直す
+		if config.DNSReresolveOnError {
+			c.forget(host)
+		}
+		return nil, err
+	}
+}
+
+// backends に書かれたすべての URL のホスト名。IP アドレスで書かれたものは含めない
+func backendHostnames() []string {
+	seen := map[string]bool{}
+	add := func(rawURL string) {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+			return
+		}
+		seen[u.Hostname()] = true
+	}
+	for _, backend := range config.Backends {
+		add(backend.URL)
+		for _, instance := range backend.Instances {
+			add(instance.URL)
+		}
+		for _, target := range backend.AuthSchemeBackends {
+			add(target)
+		}
+		add(backend.SecondaryBackend)
+		add(backend.MirrorTo)
+		add(backend.AllDownBackend)
+	}
+	hosts := make([]string, 0, len(seen))
+	for host := range seen {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// checkBackendDns: off (既定) / warn / fail
+// 起動時にバックエンドのホスト名をすべて引いて、設定の誤りを早めに見つける
+func checkBackendDNS() error {
+	if config.CheckBackendDNS == "" || config.CheckBackendDNS == "off" {
+		return nil
+	}
+	var failed []string
+	for _, host := range backendHostnames() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := backendResolver(config.ResolverAddress).LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to resolve backend host %s: %v", host, err)
+			failed = append(failed, host)
+		}
+	}
+	if len(failed) > 0 && config.CheckBackendDNS == "fail" {
+		return fmt.Errorf("cannot resolve backend hosts %v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// lookup の回数を数える dnsCache。どのホスト名も addr に解決する
+func countingDNSCache(addr string) (*dnsCache, *atomic.Int64) {
+	var lookups atomic.Int64
+	return &dnsCache{
+		entries: map[string]dnsEntry{},
+		lookup: func(ctx context.Context, host string) ([]string, error) {
+			lookups.Add(1)
+			return []string{addr}, nil
+		},
+	}, &lookups
+}
+
+func TestDNSCacheReusesLookups(t *testing.T) {
+	useConfig(t, `{"dnsCacheTTL": 60}`)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	cache, lookups := countingDNSCache("127.0.0.1")
+	dial := cache.dialContext(&net.Dialer{})
+	for i := 0; i < 3; i++ {
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort("backend.test", u.Port()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("looked up %d times, want 1", got)
+	}
+}
+
+func TestDNSCacheReresolvesOnError(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close() // 接続できないポート
+
+	for _, reresolve := range []bool{false, true} {
+		if reresolve {
+			useConfig(t, `{"dnsCacheTTL": 60, "dnsReresolveOnError": true}`)
+		} else {
+			useConfig(t, `{"dnsCacheTTL": 60}`)
+		}
+		cache, lookups := countingDNSCache("127.0.0.1")
+		dial := cache.dialContext(&net.Dialer{})
+		for i := 0; i < 2; i++ {
+			if _, err := dial(context.Background(), "tcp", net.JoinHostPort("backend.test", strconv.Itoa(port))); err == nil {
+				t.Fatal("dial to a closed port succeeded")
+			}
+		}
+		want := int64(1)
+		if reresolve {
+			want = 2
+		}
+		if got := lookups.Load(); got != want {
+			t.Errorf("dnsReresolveOnError %t: looked up %d times, want %d", reresolve, got, want)
+		}
+	}
+}
+
+// どの名前の A レコードにも 127.0.0.1 を返す DNS サーバー
+func fakeDNSServer(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries atomic.Int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) == 0 {
+				continue
+			}
+			queries.Add(1)
+			question := query.Questions[0]
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			if question.Type == dnsmessage.TypeA {
+				reply.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+			packed, _ := reply.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestResolverAddress(t *testing.T) {
+	resolver, queries := fakeDNSServer(t)
+	backend := textBackend(t, "ok")
+	u, _ := url.Parse(backend.URL)
+	useConfig(t, `{"backends": {"app.test": "http://backend.invalid:`+u.Port()+`"}, "resolverAddress": "`+resolver+`"}`)
+
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Body.String() != "ok" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if queries.Load() == 0 {
+		t.Error("configured resolver was not asked")
+	}
+}
+
+func TestBackendHostnames(t *testing.T) {
+	useConfig(t, `{"backends": {
+		"app.test": {"instances": ["http://b.internal:8080", "http://127.0.0.1:1"], "secondaryBackend": "http://a.internal", "mirrorTo": "http://b.internal"},
+		"api.test": {"url": "http://c.internal", "authSchemeBackends": {"bearer": "https://d.internal"}}
+	}}`)
+	if got := fmt.Sprint(backendHostnames()); got != "[a.internal b.internal c.internal d.internal]" {
+		t.Errorf("backendHostnames() = %s", got)
+	}
+}
+
+func TestCheckBackendDNS(t *testing.T) {
+	resolver, _ := fakeDNSServer(t)
+	// 応答しない DNS サーバーの代わりに閉じたポートを使う
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	unreachable := conn.LocalAddr().String()
+	conn.Close()
+
+	for _, tt := range []struct {
+		mode, resolver string
+		fails          bool
+	}{
+		{"fail", resolver, false},
+		{"warn", unreachable, false},
+		{"off", unreachable, false},
+		{"fail", unreachable, true},
+	} {
+		useConfig(t, `{"backends": {"app.test": "http://backend.internal"}, "checkBackendDns": "`+tt.mode+`", "resolverAddress": "`+tt.resolver+`"}`)
+		if err := checkBackendDNS(); (err != nil) != tt.fails {
+			t.Errorf("%s with %s: err = %v", tt.mode, tt.resolver, err)
+		}
+	}
+}
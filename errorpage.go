@@ -0,0 +1,45 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+var defaultErrorPage = template.Must(template.New("error").Parse(
+	`<!doctype html><title>{{.Status}} {{.StatusText}}</title><h1>{{.Status}} {{.StatusText}}</h1><p>Request ID: {{.RequestID}}</p>`,
+))
+
+// errorPageTemplate を読み込んだもの。未設定なら defaultErrorPage を使う
+var errorPage = defaultErrorPage
+
+func parseErrorPage(text string) (*template.Template, error) {
+	if text == "" {
+		return defaultErrorPage, nil
+	}
+	return template.New("error").Parse(text)
+}
+
+// バックエンドのエラーをログに残し、相関 ID 入りのエラーページを返す
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	requestID := r.Header.Get(requestIDHeader())
+	slog.Error("upstream error",
+		slog.String("request_id", requestID),
+		slog.String("host", r.Host),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.String("error", err.Error()),
+		slog.String("error_kind", upstreamErrorKind(err)),
+	)
+	if ut, ok := r.Context().Value(upstreamTraceKey{}).(*upstreamTrace); ok {
+		ut.upstreamFailed = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorPage.Execute(w, map[string]any{
+		"Status":     status,
+		"StatusText": http.StatusText(status),
+		"RequestID":  requestID,
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamErrorPageShowsRequestID(t *testing.T) {
+	useConfig(t, `{"backends": {"app.test": "http://127.0.0.1:1"}}`)
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	rec := serveProxy(r)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "Request ID: req-42") {
+		t.Errorf("got %d %q", rec.Code, rec.Body.String())
+	}
+	errors := logsWithMessage(t, "upstream error")
+	if len(errors) != 1 || errors[0]["request_id"] != "req-42" || errors[0]["status"] != float64(http.StatusBadGateway) {
+		t.Errorf("upstream error logs = %v", errors)
+	}
+}
+
+func TestErrorPageTemplate(t *testing.T) {
+	useConfig(t, `{
+		"backends": {"app.test": "http://127.0.0.1:1"},
+		"errorPageTemplate": "<p>{{.Status}} {{.StatusText}} ({{.RequestID}})</p>"
+	}`)
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("X-Request-ID", "<id>")
+	// html/template なので ID はエスケープされる
+	if got := serveProxy(r).Body.String(); got != "<p>502 Bad Gateway (&lt;id&gt;)</p>" {
+		t.Errorf("got %q", got)
+	}
+}
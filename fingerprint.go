@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type FingerprintConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Attributes []string `json:"attributes"` // ip, userAgent, acceptLanguage, tls
+	Salt       string   `json:"salt"`
+}
+
+var defaultFingerprintAttributes = []string{"ip", "userAgent", "tls"}
+
+// リクエストの属性からフィンガープリントを計算する
+// 生の値はログに残さず、HMAC-SHA256 のハッシュだけを返す
+// clientIP は handleProxy が X-Forwarded-For を書き換える前に求めた接続元
+func requestFingerprint(r *http.Request, clientIP string, fc FingerprintConfig) string {
+	attributes := fc.Attributes
+	if len(attributes) == 0 {
+		attributes = defaultFingerprintAttributes
+	}
+
+	mac := hmac.New(sha256.New, []byte(fc.Salt))
+	for _, attribute := range attributes {
+		var value string
+		switch attribute {
+		case "ip":
+			// アクセスログの client_ip と同じく、信頼できるプロキシの後ろなら本当のクライアントの IP
+			value = clientIP
+		case "userAgent":
+			value = r.UserAgent()
+		case "acceptLanguage":
+			value = r.Header.Get("Accept-Language")
+		case "tls":
+			value = tlsFingerprintSource(r.TLS)
+		}
+		// 区切りを入れて属性の境界で値が混ざらないようにする
+		fmt.Fprintf(mac, "%s=%s\n", attribute, value)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// JA3 風に TLS のネゴシエーション結果を文字列にまとめる
+func tlsFingerprintSource(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("%d", state.Version),
+		fmt.Sprintf("%d", state.CipherSuite),
+		state.NegotiatedProtocol,
+		state.ServerName,
+	}, ",")
+}
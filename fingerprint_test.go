@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	fc := FingerprintConfig{Enabled: true, Salt: "salt"}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+
+	same := httptest.NewRequest("GET", "/other", nil)
+	same.Header.Set("User-Agent", "curl/8.0")
+	if requestFingerprint(r, "192.0.2.1", fc) != requestFingerprint(same, "192.0.2.1", fc) {
+		t.Error("same client got different fingerprints")
+	}
+
+	other := httptest.NewRequest("GET", "/", nil)
+	other.Header.Set("User-Agent", "Mozilla/5.0")
+	if requestFingerprint(r, "192.0.2.1", fc) == requestFingerprint(other, "192.0.2.1", fc) {
+		t.Error("different user agents got the same fingerprint")
+	}
+
+	if requestFingerprint(r, "192.0.2.1", fc) == requestFingerprint(r, "192.0.2.1", FingerprintConfig{Salt: "pepper"}) {
+		t.Error("fingerprint does not depend on the salt")
+	}
+
+	// 選んだ属性だけを使う
+	onlyLanguage := FingerprintConfig{Attributes: []string{"acceptLanguage"}}
+	if requestFingerprint(r, "192.0.2.1", onlyLanguage) != requestFingerprint(other, "192.0.2.1", onlyLanguage) {
+		t.Error("user agent changed a fingerprint that does not use it")
+	}
+}
+
+func TestFingerprintInAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"fingerprint": {"enabled": true, "salt": "s"}
+	}`)
+
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "secret-agent/1.0")
+	serveProxy(r)
+
+	entry := lastAccessLog(t)
+	fingerprint, _ := entry["fingerprint"].(string)
+	if len(fingerprint) != 64 {
+		t.Fatalf("fingerprint = %q, want a hex SHA-256", fingerprint)
+	}
+	// 生の値はログに出さない
+	if strings.Contains(testLog.String(), "secret-agent") {
+		t.Error("raw user agent was logged")
+	}
+}
+
+func TestFingerprintUsesClientIPBehindProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"trustedProxyCIDRs": ["10.0.0.0/8"], "trustedProxyHops": 1,
+		"fingerprint": {"enabled": true, "salt": "s", "attributes": ["ip"]}
+	}`)
+
+	// 10.0.0.1 のロードバランサーの後ろにいる 1.2.3.4 のクライアント
+	r := appRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	serveProxy(r)
+
+	entry := lastAccessLog(t)
+	if entry["client_ip"] != "1.2.3.4" {
+		t.Errorf("client_ip = %v", entry["client_ip"])
+	}
+	if want := requestFingerprint(r, "1.2.3.4", config.Fingerprint); entry["fingerprint"] != want {
+		t.Errorf("fingerprint = %v, want the one for 1.2.3.4", entry["fingerprint"])
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// flushStatuses に含まれるステータスのレスポンスだけを書き込みのたびにクライアントへ送り出す
+// それ以外はレスポンスが終わるまで (またはサーバーのバッファがいっぱいになるまで) ためておく
+type flushByStatusWriter struct {
+	http.ResponseWriter
+	statuses []int
+	flush    bool
+}
+
+func (w *flushByStatusWriter) WriteHeader(code int) {
+	// 1xx の後にも本当のステータスが来る
+	if code >= http.StatusOK {
+		w.flush = slices.Contains(w.statuses, code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *flushByStatusWriter) Flush() {
+	if w.flush {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *flushByStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
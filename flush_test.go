@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlushStatuses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("chunk"))
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "flushStatuses": [200]}}}`)
+
+	if rec := serveProxy(appRequest("GET", "/stream", nil)); !rec.Flushed || rec.Body.String() != "chunk" {
+		t.Errorf("200: flushed %v, body %q", rec.Flushed, rec.Body.String())
+	}
+	if rec := serveProxy(appRequest("GET", "/error", nil)); rec.Flushed || rec.Body.String() != "chunk" {
+		t.Errorf("500: flushed %v, body %q", rec.Flushed, rec.Body.String())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// net/http は Content-Length と Transfer-Encoding を両方持つリクエストから Content-Length を消すので、
+// ハンドラーからは併用されていたかがわからない
+// そこで平文の接続では読んだバイトからメッセージの区切りを追い、併用したリクエストが来たかを接続ごとに覚えておく
+type framingListener struct {
+	net.Listener
+}
+
+func newFramingListener(ln net.Listener) net.Listener {
+	return framingListener{ln}
+}
+
+func (l framingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: conn, requestLine: true}, nil
+}
+
+type framingConnKey struct{}
+
+// http.Server の ConnContext に渡し、ハンドラーから接続の記録を引けるようにする
+func framingConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if fc, ok := conn.(*framingConn); ok {
+		return context.WithValue(ctx, framingConnKey{}, fc)
+	}
+	return ctx
+}
+
+const (
+	framingHeaders = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingTrailers
+	framingUnknown // 区切りを見失ったので、これ以降は追わない
+)
+
+// ヘッダーの 1 行がこれより長ければ net/http も受け付けない
+const maxFramingLine = 1 << 20
+
+type framingConn struct {
+	net.Conn
+	mu          sync.Mutex
+	state       int
+	line        []byte
+	requestLine bool
+	remaining   int64
+	hasCL       bool
+	hasTE       bool
+	contentLen  int64
+	ambiguous   bool
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	// Read が返った時点で読んだ分は追い終えているので、そのリクエストのハンドラーからは必ず結果が見える
+	c.mu.Lock()
+	c.feed(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// これまでに Content-Length と Transfer-Encoding を併用したリクエストが来ていれば true
+func (c *framingConn) sawAmbiguousFraming() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ambiguous
+}
+
+func (c *framingConn) feed(p []byte) {
+	for len(p) > 0 && c.state != framingUnknown {
+		if c.state == framingBody || c.state == framingChunkData {
+			n := min(int64(len(p)), c.remaining)
+			c.remaining -= n
+			p = p[n:]
+			if c.remaining == 0 {
+				if c.state == framingBody {
+					c.state = framingHeaders
+				} else {
+					c.state = framingChunkSize
+				}
+			}
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.line = append(c.line, p...)
+			if len(c.line) > maxFramingLine {
+				c.state = framingUnknown
+			}
+			return
+		}
+		c.line = append(c.line, p[:i]...)
+		p = p[i+1:]
+		c.handleLine(bytes.TrimSuffix(c.line, []byte("\r")))
+		c.line = c.line[:0]
+	}
+}
+
+func (c *framingConn) handleLine(line []byte) {
+	switch c.state {
+	case framingHeaders:
+		if c.requestLine {
+			c.requestLine = false
+			return
+		}
+		if len(line) > 0 {
+			c.handleHeader(line)
+			return
+		}
+		// ヘッダーの終わり
+		if c.hasCL && c.hasTE {
+			c.ambiguous = true
+		}
+		switch {
+		case c.hasTE:
+			// net/http は chunked 以外を受け付けないので chunked として追う
+			c.state = framingChunkSize
+		case c.contentLen > 0:
+			c.state, c.remaining = framingBody, c.contentLen
+		}
+		c.requestLine, c.hasCL, c.hasTE, c.contentLen = true, false, false, 0
+	case framingChunkSize:
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			c.state = framingUnknown
+		case n == 0:
+			c.state = framingTrailers
+		default:
+			// チャンクの後ろの CRLF も本文として読み飛ばす
+			c.state, c.remaining = framingChunkData, n+2
+		}
+	case framingTrailers:
+		if len(line) == 0 {
+			c.state, c.requestLine = framingHeaders, true
+		}
+	}
+}
+
+func (c *framingConn) handleHeader(line []byte) {
+	name, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok {
+		c.state = framingUnknown
+		return
+	}
+	switch {
+	case bytes.EqualFold(name, []byte("Content-Length")):
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(value)), 10, 64)
+		if err != nil || n < 0 {
+			c.state = framingUnknown
+			return
+		}
+		c.hasCL, c.contentLen = true, n
+	case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+		c.hasTE = true
+	}
+}
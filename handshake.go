@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxConcurrentHandshakes を設定したときは TLS のハンドシェイクをリスナーで済ませてから http.Server に渡す
+// 同時に進めるハンドシェイクが上限に達すると、空きが出るまで次の接続を受け付けない
+func serveTLS(server *http.Server, ln net.Listener, certFile, keyFile string) error {
+	if config.MaxConcurrentHandshakes <= 0 {
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+	tlsConfig := server.TLSConfig.Clone()
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	// ServeTLS と違い Serve は NextProtos を補わないので、HTTP/2 を使えるよう h2 を入れておく
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	server.TLSConfig = tlsConfig
+	return server.Serve(newHandshakeListener(ln, tlsConfig, config.MaxConcurrentHandshakes))
+}
+
+type handshakeListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	slots     chan struct{}
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHandshakeListener(ln net.Listener, tlsConfig *tls.Config, maxHandshakes int) *handshakeListener {
+	l := &handshakeListener{
+		Listener:  ln,
+		tlsConfig: tlsConfig,
+		slots:     make(chan struct{}, maxHandshakes),
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *handshakeListener) handshake(conn net.Conn) {
+	timeout := 10 * time.Second
+	if config.ReadTimeout > 0 {
+		timeout = seconds(config.ReadTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	tlsConn := tls.Server(conn, l.tlsConfig)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	<-l.slots
+	if err != nil {
+		log.Printf("http: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
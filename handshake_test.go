@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	useConfig(t, `{"maxConcurrentHandshakes": 1}`)
+	_, certPEM, keyPEM := selfSignedCert(t, "app.test", time.Now().Add(time.Hour), x509.ExtKeyUsageServerAuth)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0644)
+	os.WriteFile(keyFile, keyPEM, 0600)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), TLSConfig: &tls.Config{}}
+	go serveTLS(server, ln, certFile, keyFile)
+	defer server.Close()
+
+	// ClientHello を送らない接続でハンドシェイクの枠を埋める
+	stalled, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	result := make(chan *tls.Conn, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Error(err)
+		}
+		result <- conn
+	}()
+	select {
+	case <-result:
+		t.Fatal("handshake finished while the only slot was taken")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	stalled.Close()
+	select {
+	case conn := <-result:
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+			t.Errorf("negotiated %q, want h2", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake did not finish after the slot was freed")
+	}
+}
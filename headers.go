@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// タブ以外の制御文字と DEL は net/http が 400 で弾くので、ここで見るのは通ってしまうものだけ
+// タブと、HTTP/2 では切り詰められずに届く前後の空白
+func hasDisallowedHeaderBytes(value string) bool {
+	return strings.ContainsRune(value, '\t') || value != strings.TrimSpace(value)
+}
+
+func sanitizeHeaderValue(value string) string {
+	return strings.TrimSpace(strings.ReplaceAll(value, "\t", ""))
+}
+
+// headerValidation の設定に従ってヘッダー値を検査する
+// reject のときに不正な値があれば false を返す
+func validateHeaderValues(r *http.Request) bool {
+	if config.HeaderValidation != "reject" && config.HeaderValidation != "sanitize" {
+		return true
+	}
+	for name, values := range r.Header {
+		for i, value := range values {
+			if !hasDisallowedHeaderBytes(value) {
+				continue
+			}
+			if config.HeaderValidation == "reject" {
+				log.Printf("Rejected request from %s: invalid value in header %s", r.RemoteAddr, name)
+				return false
+			}
+			values[i] = sanitizeHeaderValue(value)
+		}
+	}
+	return true
+}
+
+// リクエストスマグリングに使われるあいまいなメッセージ長の指定を検出する
+// Content-Length の食い違いは net/http が 400 で弾くので、見るのは Transfer-Encoding との併用だけ
+// TLS の接続では復号した後のバイトを追えないので、検出できるのは平文で受けたリクエストに限られる
+func ambiguousFraming(r *http.Request) string {
+	if fc, ok := r.Context().Value(framingConnKey{}).(*framingConn); ok && fc.sawAmbiguousFraming() {
+		return "both Content-Length and Transfer-Encoding"
+	}
+	return ""
+}
+
+// 絶対形式のリクエストを通常の形に直す
+// Host は net/http がすでに URL のホストにしているので、そのまま振り分けに使う
+func normalizeAbsoluteForm(r *http.Request) {
+	r.URL.Scheme = ""
+	r.URL.Host = ""
+	r.RequestURI = r.URL.RequestURI()
+}
+
+// allowedContentTypes が空なら何でも通す。本文を持つリクエストだけを検査する
+func allowedContentType(r *http.Request, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	// ContentLength が -1 (chunked など長さ不明) のときも本文があるものとして調べる
+	if r.ContentLength == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, v := range allowed {
+		if strings.EqualFold(mediaType, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// minHttpVersion ("1.1" など) より古いプロトコルのリクエストなら false を返す
+func meetsMinHTTPVersion(r *http.Request) bool {
+	if config.MinHTTPVersion == "" {
+		return true
+	}
+	// 読み込むときに検査しているので ParseHTTPVersion は失敗しない
+	major, minor, _ := http.ParseHTTPVersion("HTTP/" + config.MinHTTPVersion)
+	return r.ProtoAtLeast(major, minor)
+}
+
+// RFC で決まっているもの (ReverseProxy が消す) に加えて取り除く内部用のヘッダー
+type StripHeadersConfig struct {
+	Request  []string `json:"request"`  // バックエンドに送らない
+	Response []string `json:"response"` // クライアントに返さない
+}
+
+func stripHeaders(header http.Header, names []string) {
+	for _, name := range names {
+		header.Del(name)
+	}
+}
+
+// 同じ名前のヘッダーが複数あればそれぞれを数える
+func headerCount(header http.Header) int {
+	n := 0
+	for _, values := range header {
+		n += len(values)
+	}
+	return n
+}
+
+// responseHeaderAllowlist があっても本文を正しく受け取るのに要るものは残す
+var essentialResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "Location", "Date"}
+
+// allow (と essentialResponseHeaders) にないヘッダーをすべて取り除く
+func allowHeaders(header http.Header, allow []string) {
+	for name := range header {
+		if !containsHeaderName(allow, name) && !containsHeaderName(essentialResponseHeaders, name) {
+			header.Del(name)
+		}
+	}
+}
+
+func containsHeaderName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
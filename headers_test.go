@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeaderValidation(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Note")
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		mode   string
+		status int
+		want   string
+	}{
+		{"off", http.StatusOK, "a\tb"},
+		{"reject", http.StatusBadRequest, ""},
+		{"sanitize", http.StatusOK, "ab"},
+	} {
+		got = ""
+		useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "headerValidation": "`+tt.mode+`"}`)
+		r := appRequest("GET", "/", nil)
+		// HTTP/2 では前後の空白も切り詰められずに届く
+		r.Header.Set("X-Note", " a\tb ")
+		rec := serveProxy(r)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.mode, rec.Code, tt.status)
+		}
+		if got != tt.want {
+			t.Errorf("%s: backend got %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+// 生のリクエストを 1 本の接続で順に送り、返ってきたステータスを並べる
+func rawRequests(t *testing.T, proxy *httptest.Server, requests ...string) []int {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, strings.Join(requests, ""))
+	br := bufio.NewReader(conn)
+	var statuses []int
+	for range requests {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			break
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	return statuses
+}
+
+func TestAmbiguousFramingRejected(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	proxy := newProxyServer(t)
+
+	// net/http は Content-Length を消して chunked として読むので、ハンドラーまで届く
+	// 後ろに隠したリクエストも接続ごと捨てる
+	smuggled := "POST / HTTP/1.1\r\nHost: app.test\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	hidden := "GET /admin HTTP/1.1\r\nHost: app.test\r\n\r\n"
+	if got := rawRequests(t, proxy, smuggled, hidden); fmt.Sprint(got) != "[400]" {
+		t.Errorf("Content-Length with Transfer-Encoding: got %v, want [400]", got)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("backend was hit %d times", hits.Load())
+	}
+	if !strings.Contains(testLog.String(), "both Content-Length and Transfer-Encoding") {
+		t.Errorf("log = %s", testLog.String())
+	}
+
+	conflicting := "POST / HTTP/1.1\r\nHost: app.test\r\nContent-Length: 4\r\nContent-Length: 5\r\n\r\nabcde"
+	if got := rawRequests(t, proxy, conflicting); fmt.Sprint(got) != "[400]" {
+		t.Errorf("conflicting Content-Length: got %v, want [400]", got)
+	}
+
+	// chunked と Content-Length のリクエストを別々に送るのは問題ない
+	chunked := "POST / HTTP/1.1\r\nHost: app.test\r\nTransfer-Encoding: chunked\r\n\r\n4;ext=1\r\nabcd\r\n0\r\nX-Trailer: 1\r\n\r\n"
+	sized := "POST / HTTP/1.1\r\nHost: app.test\r\nContent-Length: 4\r\n\r\nabcd"
+	if got := rawRequests(t, proxy, chunked, sized, chunked); fmt.Sprint(got) != "[200 200 200]" {
+		t.Errorf("separate framings: got %v, want [200 200 200]", got)
+	}
+}
+
+func TestAllowedContentTypes(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "allowedContentTypes": ["application/json"]}}}`)
+
+	for _, tt := range []struct {
+		method, contentType, body string
+		want                      int
+	}{
+		{"POST", "application/json; charset=utf-8", "{}", http.StatusOK},
+		{"POST", "text/plain", "hi", http.StatusUnsupportedMediaType},
+		{"POST", "", "hi", http.StatusUnsupportedMediaType},
+		// 本文がなければ Content-Type は見ない
+		{"GET", "", "", http.StatusOK},
+		{"DELETE", "text/plain", "", http.StatusOK},
+	} {
+		r := appRequest(tt.method, "/", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if rec := serveProxy(r); rec.Code != tt.want {
+			t.Errorf("%s %q with %q: got %d, want %d", tt.method, tt.body, tt.contentType, rec.Code, tt.want)
+		}
+	}
+
+	// chunked で長さが分からない本文も調べる
+	r := appRequest("POST", "/", strings.NewReader("hi"))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "text/plain")
+	if rec := serveProxy(r); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("chunked text/plain: got %d", rec.Code)
+	}
+}
+
+func TestMinHTTPVersion(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "minHttpVersion": "1.1"}`)
+
+	r := appRequest("GET", "/", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0
+	if rec := serveProxy(r); rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("HTTP/1.0: got %d, want 505", rec.Code)
+	}
+	r = appRequest("GET", "/", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	if rec := serveProxy(r); rec.Code != http.StatusOK {
+		t.Errorf("HTTP/2: got %d, want 200", rec.Code)
+	}
+
+	for _, v := range []string{"1", "one", "1.1.1"} {
+		if err := applyConfigJson([]byte(`{"minHttpVersion": "` + v + `"}`)); err == nil {
+			t.Errorf("minHttpVersion %q was accepted", v)
+		}
+	}
+}
+
+func TestStripHopByHopHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("X-Internal-Trace", "abc")
+		w.Header().Set("X-Public", "yes")
+	}))
+	defer backend.Close()
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"stripHopByHopHeaders": {"request": ["X-Debug-Token"], "response": ["X-Internal-Trace"]}
+	}`)
+
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("X-Debug-Token", "secret")
+	r.Header.Set("X-Other", "kept")
+	rec := serveProxy(r)
+	if got.Get("X-Debug-Token") != "" || got.Get("X-Other") != "kept" {
+		t.Errorf("backend got headers %v", got)
+	}
+	if rec.Header().Get("X-Internal-Trace") != "" || rec.Header().Get("X-Public") != "yes" {
+		t.Errorf("client got headers %v", rec.Header())
+	}
+}
+
+func TestHeaderCountsInAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		w.Header().Add("X-A", "1")
+		w.Header().Add("X-A", "2")
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+
+	r := appRequest("GET", "/", nil)
+	r.Header.Add("Accept", "a")
+	r.Header.Add("Accept", "b")
+	r.Header.Set("User-Agent", "test")
+	rec := serveProxy(r)
+
+	entry := lastAccessLog(t)
+	// X-Forwarded-For など転送のために足したものは数えない
+	if entry["req_header_count"] != float64(3) {
+		t.Errorf("req_header_count = %v, want 3", entry["req_header_count"])
+	}
+	if want := float64(headerCount(rec.Header())); entry["resp_header_count"] != want {
+		t.Errorf("resp_header_count = %v, want %v (%v)", entry["resp_header_count"], want, rec.Header())
+	}
+}
+
+func TestUpstreamAcceptEncoding(t *testing.T) {
+	var got []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values("Accept-Encoding")
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		setting, client, want string
+	}{
+		{``, "br", "br"},
+		{`, "upstreamAcceptEncoding": "identity"`, "br, gzip", "identity"},
+		// 取り除いたときは Transport も gzip を足さない
+		{`, "upstreamAcceptEncoding": ""`, "br", ""},
+		{`, "upstreamAcceptEncoding": ""`, "", ""},
+	} {
+		useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`"`+tt.setting+`}}}`)
+		got = nil
+		r := appRequest("GET", "/", nil)
+		if tt.client != "" {
+			r.Header.Set("Accept-Encoding", tt.client)
+		}
+		serveProxy(r)
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("setting %q, client %q: backend got %q, want %q", tt.setting, tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestAbsoluteFormURI(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	if rec := serveProxy(httptest.NewRequest("GET", "http://app.test/hello?x=1", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("absolute-form by default: got %d, want 400", rec.Code)
+	}
+
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "allowAbsoluteFormURIs": true}`)
+	rec := serveProxy(httptest.NewRequest("GET", "http://app.test/hello?x=1", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/hello?x=1" {
+		t.Errorf("allowed absolute-form: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestResponseHeaderAllowlist(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Public", "yes")
+		w.Header().Set("X-Powered-By", "framework/1.0")
+		w.Header().Set("Set-Cookie", "session=backend")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "responseHeaderAllowlist": ["x-public"]}}}`)
+
+	rec := serveProxy(appRequest("GET", "/", nil))
+	h := rec.Header()
+	if h.Get("X-Public") != "yes" || h.Get("Content-Type") != "text/plain" || h.Get("Content-Length") != "2" {
+		t.Errorf("allowed headers were removed: %v", h)
+	}
+	if h.Get("X-Powered-By") != "" {
+		t.Errorf("X-Powered-By reached the client: %v", h)
+	}
+	// user_uuid のようにプロキシが付けるクッキーは残り、バックエンドのものは消える
+	cookies := strings.Join(h.Values("Set-Cookie"), "\n")
+	if strings.Contains(cookies, "session=") || !strings.Contains(cookies, uuidCookieName+"=") {
+		t.Errorf("Set-Cookie = %v", h.Values("Set-Cookie"))
+	}
+}
+
+func TestResponseHeaderAllowlistKeepsUpgrades(t *testing.T) {
+	backend := upgradeBackend(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "responseHeaderAllowlist": ["x-public"]}}}`)
+	status, conn := dialWebSocket(t, newProxyServer(t))
+	conn.Close()
+	if status != http.StatusSwitchingProtocols {
+		t.Errorf("upgrade with an allowlist: got %d, want 101", status)
+	}
+}
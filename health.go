@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// 受動的なヘルスチェック
+// バックエンドに接続できない・応答がないときにインスタンスを instanceCooldown の間だけ振り分けから外す
+func (rt *route) trackHealth(i int, proxy *httputil.ReverseProxy) {
+	if rt.backend.InstanceCooldown <= 0 {
+		return
+	}
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if kind := upstreamErrorKind(err); isTransportFailure(kind) {
+			if rt.failedAt[i].Swap(time.Now().UnixNano()) == 0 {
+				log.Printf("Instance %s failed (%s), skipping it for %d seconds", rt.instances[i].URL, kind, rt.backend.InstanceCooldown)
+			}
+		}
+		errorHandler(w, r, err)
+	}
+}
+
+func (rt *route) healthy(i int) bool {
+	if rt.backend.InstanceCooldown <= 0 {
+		return true
+	}
+	failedAt := rt.failedAt[i].Load()
+	if failedAt == 0 {
+		return true
+	}
+	if time.Since(time.Unix(0, failedAt)) < seconds(rt.backend.InstanceCooldown) {
+		return false
+	}
+	// 外す期間が過ぎたら次のリクエストで試し直す。また失敗すれば外れる
+	rt.failedAt[i].CompareAndSwap(failedAt, 0)
+	return true
+}
+
+func anyInstance(int) bool {
+	return true
+}
+
+// 失敗してからいちばん時間が経っている (そろそろ戻っていそうな) インスタンス
+func (rt *route) leastRecentlyFailed() int {
+	best := 0
+	for i := range rt.failedAt {
+		if rt.failedAt[i].Load() < rt.failedAt[best].Load() {
+			best = i
+		}
+	}
+	return best
+}
+
+// allDownBackend があればそこへ送り、なければ allDownBody を 503 で返す
+func (rt *route) setAllDown(cfg *Config) error {
+	if rt.backend.AllDownBackend != "" {
+		proxy, err := newProxy(rt.backend, cfg, rt.backend.AllDownBackend)
+		if err != nil {
+			return err
+		}
+		rt.allDown = proxy
+		return nil
+	}
+	if body := rt.backend.AllDownBody; body != "" {
+		rt.allDown = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, body, http.StatusServiceUnavailable)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstanceCooldownSkipsFailedInstance(t *testing.T) {
+	live := textBackend(t, "live")
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"instances": ["http://127.0.0.1:1", %q], "instanceCooldown": 60}}}`, live.URL))
+
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusBadGateway {
+		t.Fatalf("first request to the dead instance: got %d", rec.Code)
+	}
+	if len(logsWithMessage(t, "Instance http://127.0.0.1:1 failed (refused), skipping it for 60 seconds")) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+	for i := 0; i < 4; i++ {
+		if rec := serveProxy(appRequest("GET", "/", nil)); rec.Body.String() != "live" {
+			t.Errorf("request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestInstanceCooldownCountsTimeouts(t *testing.T) {
+	// ハンドシェイクが時間切れになったインスタンスも外す
+	ln := silentListener(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "https://`+ln.Addr().String()+`", "tlsHandshakeTimeout": 50, "instanceCooldown": 60}}}`)
+	serveProxy(appRequest("GET", "/", nil))
+	if routes["app.test"].healthy(0) {
+		t.Error("instance is still healthy after a TLS handshake timeout")
+	}
+	if len(logsWithMessage(t, "Instance https://"+ln.Addr().String()+" failed (tls_handshake_timeout), skipping it for 60 seconds")) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+
+	// 接続の時間切れはテストで確実には起こせないので、ダイヤラーが返すエラーをそのまま渡す
+	useConfig(t, `{"backends": {"app.test": {"url": "http://192.0.2.1", "connectTimeout": 50, "instanceCooldown": 60}}}`)
+	rt := routes["app.test"]
+	rt.proxies[0].ErrorHandler(httptest.NewRecorder(), appRequest("GET", "/", nil), &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded})
+	if rt.healthy(0) {
+		t.Error("instance is still healthy after a connect timeout")
+	}
+	if len(logsWithMessage(t, "Instance http://192.0.2.1 failed (connect_timeout), skipping it for 60 seconds")) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+}
+
+func TestAllInstancesDown(t *testing.T) {
+	fallback := textBackend(t, "fallback")
+	useConfig(t, `{"backends": {
+		"app.test": {"url": "http://127.0.0.1:1", "instanceCooldown": 60, "allDownBody": "come back later"},
+		"fallback.test": {"url": "http://127.0.0.1:1", "instanceCooldown": 60, "allDownBackend": "`+fallback.URL+`"},
+		"plain.test": {"url": "http://127.0.0.1:1", "instanceCooldown": 60}
+	}}`)
+
+	for _, tt := range []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"app.test", http.StatusServiceUnavailable, "come back later\n"},
+		{"fallback.test", http.StatusOK, "fallback"},
+		// どちらもなければ外れたインスタンスにそのまま送る
+		{"plain.test", http.StatusBadGateway, ""},
+	} {
+		r := appRequest("GET", "/", nil)
+		r.Host = tt.host
+		serveProxy(r)
+		r = appRequest("GET", "/", nil)
+		r.Host = tt.host
+		rec := serveProxy(r)
+		if rec.Code != tt.status || !strings.HasPrefix(rec.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %q", tt.host, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestEmptyPoolPolicy(t *testing.T) {
+	a, b := textBackend(t, "a"), textBackend(t, "b")
+	now := time.Now()
+	for _, tt := range []struct {
+		policy           string
+		failedA, failedB time.Time
+		status           int
+		body             string
+	}{
+		{"fail", now.Add(-2 * time.Second), now, http.StatusServiceUnavailable, "Service Unavailable\n"},
+		// 失敗が最も古いインスタンスなら戻っている見込みが一番高い
+		{"tryLastResort", now.Add(-2 * time.Second), now, http.StatusOK, "a"},
+		{"tryLastResort", now, now.Add(-2 * time.Second), http.StatusOK, "b"},
+	} {
+		useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"instances": [%q, %q], "instanceCooldown": 60, "emptyPoolPolicy": %q}}}`, a.URL, b.URL, tt.policy))
+		rt := routes["app.test"]
+		rt.failedAt[0].Store(tt.failedA.UnixNano())
+		rt.failedAt[1].Store(tt.failedB.UnixNano())
+		for i := 0; i < 2; i++ {
+			if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != tt.status || rec.Body.String() != tt.body {
+				t.Errorf("%s: got %d %q, want %d %q", tt.policy, rec.Code, rec.Body.String(), tt.status, tt.body)
+			}
+		}
+	}
+
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "emptyPoolPolicy": "random"}}}`)); err == nil {
+		t.Error("unknown emptyPoolPolicy was accepted")
+	}
+}
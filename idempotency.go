@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idempotency-Key 付きの POST などを idempotencyKeyTTL の間覚えておき、
+// 同じキーで送り直されたらバックエンドに送らずに最初のレスポンスを返す
+type idempotencyCache struct {
+	header       string
+	apiKeyHeader string
+	ttl          time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+type idempotentResponse struct {
+	done    chan struct{}
+	stored  bool // false ならエントリは消されていて、待っていた側は自分で送る
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func newIdempotencyCache(backend Backend) *idempotencyCache {
+	header := backend.IdempotencyKeyHeader
+	if header == "" {
+		header = "Idempotency-Key"
+	}
+	return &idempotencyCache{
+		header:       header,
+		apiKeyHeader: backend.APIKeyHeader,
+		ttl:          seconds(backend.IdempotencyKeyTTL),
+		entries:      map[string]*idempotentResponse{},
+	}
+}
+
+// GET などの安全なメソッドはもともと何度送ってもよいので対象にしない
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+func (c *idempotencyCache) key(r *http.Request) string {
+	idempotencyKey := r.Header.Get(c.header)
+	if idempotencyKey == "" || !unsafeMethod(r.Method) {
+		return ""
+	}
+	// 別のユーザーや別のエンドポイントのキーとは混ぜない。利用者は Authorization / Cookie / API キーで見分ける
+	parts := []string{r.Header.Get("Authorization"), strings.Join(r.Header.Values("Cookie"), "; ")}
+	if c.apiKeyHeader != "" {
+		parts = append(parts, r.Header.Get(c.apiKeyHeader))
+	}
+	return strings.Join(append(parts, r.Method, r.URL.Path, idempotencyKey), "\n")
+}
+
+// 期限切れのものをときどきまとめて消す
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, entry := range c.entries {
+		if entry.stored && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// キーがないリクエストはそのまま forward に渡す
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, forward http.HandlerFunc) {
+	key := c.key(r)
+	if key == "" {
+		forward(w, r)
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	c.sweep(now)
+	if entry, ok := c.entries[key]; ok && (!entry.stored || now.Before(entry.expires)) {
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return
+		}
+		if !entry.stored {
+			forward(w, r)
+			return
+		}
+		for name, values := range entry.header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(entry.status)
+		w.Write(entry.body)
+		return
+	}
+	entry := &idempotentResponse{done: make(chan struct{})}
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	// 5xx や一時的な 4xx、途中で切れたレスポンスは覚えず、送り直しでもう一度バックエンドに届くようにする
+	rec := &coalesceRecorder{ResponseWriter: w, before: w.Header().Clone()}
+	completed := false
+	defer func() {
+		c.mu.Lock()
+		if completed && r.Context().Err() == nil && replayableStatus(rec.status) && !rec.overflow {
+			entry.stored = true
+			entry.expires = time.Now().Add(c.ttl)
+			entry.status, entry.header, entry.body = rec.status, rec.header, rec.body.Bytes()
+		} else {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		close(entry.done)
+	}()
+	forward(rec, r)
+	completed = true
+}
+
+// 2xx と、送り直しても結果が変わらない 4xx だけを覚える
+func replayableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusLocked, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 200 && status < 300 || status >= 400 && status < 500
+}
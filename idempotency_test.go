@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// 呼ばれた回数を本文で返すバックエンド。/conflict には 409 を返す
+func orderBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if r.URL.Path == "/conflict" {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprintf(w, "order %d", n)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &hits
+}
+
+func postWithKey(path, key, authorization string) *http.Request {
+	r := appRequest("POST", path, nil)
+	r.Header.Set("Idempotency-Key", key)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	backend, hits := orderBackend(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "idempotencyKeyTTL": 60}}}`)
+
+	first := serveProxy(postWithKey("/orders", "k1", "Bearer alice"))
+	second := serveProxy(postWithKey("/orders", "k1", "Bearer alice"))
+	if hits.Load() != 1 {
+		t.Errorf("backend was hit %d times, want 1", hits.Load())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay: got %d %q %v", second.Code, second.Body.String(), second.Header())
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("first response was marked as replayed")
+	}
+}
+
+func TestIdempotencyKeyDoesNotReplay(t *testing.T) {
+	backend, hits := orderBackend(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "idempotencyKeyTTL": 60}}}`)
+
+	for _, tt := range []struct {
+		name          string
+		first, second *http.Request
+	}{
+		// 同じキーでも別の利用者のレスポンスは返さない
+		{"other credentials", postWithKey("/orders", "k2", "Bearer alice"), postWithKey("/orders", "k2", "Bearer mallory")},
+		{"other path", postWithKey("/orders", "k3", ""), postWithKey("/refunds", "k3", "")},
+		// 409 は送り直すと結果が変わりうるので覚えない
+		{"conflict", postWithKey("/conflict", "k4", ""), postWithKey("/conflict", "k4", "")},
+	} {
+		hits.Store(0)
+		serveProxy(tt.first)
+		second := serveProxy(tt.second)
+		if hits.Load() != 2 || second.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("%s: backend was hit %d times, replayed %q", tt.name, hits.Load(), second.Header().Get("Idempotent-Replayed"))
+		}
+	}
+
+	// GET は対象にしない
+	hits.Store(0)
+	for i := 0; i < 2; i++ {
+		r := appRequest("GET", "/orders", nil)
+		r.Header.Set("Idempotency-Key", "k5")
+		serveProxy(r)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("GET: backend was hit %d times, want 2", hits.Load())
+	}
+}
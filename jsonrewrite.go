@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultJSONRewriteMaxBytes = 1 << 20
+
+type JSONRewriteConfig struct {
+	Remove   []string          `json:"remove"`   // "debug" や "meta.trace" のようにドットでネストを指定する
+	Rename   map[string]string `json:"rename"`   // 元のフィールド名 → 新しいフィールド名 (同じ階層)
+	MaxBytes int               `json:"maxBytes"` // これより大きいレスポンスはそのまま返す
+}
+
+func (c JSONRewriteConfig) enabled() bool {
+	return len(c.Remove) > 0 || len(c.Rename) > 0
+}
+
+// application/json のレスポンスからフィールドを削除・改名する
+// 圧縮されたものや上限を超えるものは手を付けない
+func rewriteJSONResponse(response *http.Response, rc JSONRewriteConfig) error {
+	if !rc.enabled() || response.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil
+	}
+	maxBytes := rc.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultJSONRewriteMaxBytes
+	}
+	if response.ContentLength > int64(maxBytes) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, int64(maxBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxBytes {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return nil
+	}
+	response.Body.Close()
+
+	rewritten := body
+	var doc any
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err == nil {
+		for _, path := range rc.Remove {
+			removeJSONField(doc, strings.Split(path, "."))
+		}
+		for from, to := range rc.Rename {
+			renameJSONField(doc, strings.Split(from, "."), to)
+		}
+		if b, err := json.Marshal(doc); err == nil {
+			rewritten = b
+		}
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(rewritten))
+	response.ContentLength = int64(len(rewritten))
+	response.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	return nil
+}
+
+// 配列の中のオブジェクトにも同じパスを適用する
+func removeJSONField(doc any, path []string) {
+	switch v := doc.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		removeJSONField(v[path[0]], path[1:])
+	case []any:
+		for _, item := range v {
+			removeJSONField(item, path)
+		}
+	}
+}
+
+func renameJSONField(doc any, path []string, to string) {
+	switch v := doc.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			if value, ok := v[path[0]]; ok {
+				delete(v, path[0])
+				v[to] = value
+			}
+			return
+		}
+		renameJSONField(v[path[0]], path[1:], to)
+	case []any:
+		for _, item := range v {
+			renameJSONField(item, path, to)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func jsonBackend(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestJSONRewrite(t *testing.T) {
+	backend := jsonBackend(t, `{"id": 12345678901234567890, "debug": true, "meta": {"trace": "x", "v": 1}, "items": [{"secret": 1, "name": "a"}]}`)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "jsonRewrite": {
+		"remove": ["debug", "meta.trace", "items.secret"],
+		"rename": {"meta.v": "version", "id": "ID"}
+	}}}}`)
+
+	rec := serveProxy(appRequest("GET", "/", nil))
+	// 大きな数値も丸めずに残す
+	want := `{"ID":12345678901234567890,"items":[{"name":"a"}],"meta":{"version":1}}`
+	if rec.Body.String() != want {
+		t.Errorf("got %s, want %s", rec.Body.String(), want)
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+		t.Errorf("Content-Length = %s", rec.Header().Get("Content-Length"))
+	}
+}
+
+func TestJSONRewriteLeavesOtherResponses(t *testing.T) {
+	body := `{"debug": true, "padding": "0123456789"}`
+	backend := jsonBackend(t, body)
+	// maxBytes を超えるものは書き換えない
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "jsonRewrite": {"remove": ["debug"], "maxBytes": 10}}}}`)
+	if got := serveProxy(appRequest("GET", "/", nil)).Body.String(); got != body {
+		t.Errorf("over maxBytes: got %s", got)
+	}
+
+	text := textBackend(t, `{"debug": true}`)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+text.URL+`", "jsonRewrite": {"remove": ["debug"]}}}}`)
+	if got := serveProxy(appRequest("GET", "/", nil)).Body.String(); got != `{"debug": true}` {
+		t.Errorf("non-JSON Content-Type: got %s", got)
+	}
+}
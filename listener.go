@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/net/netutil"
+)
+
+// メインの https リスナーを作る
+func listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if config.ReusePort {
+		// 複数のプロセスで同じポートを共有する
+		lc := net.ListenConfig{Control: reusePortControl}
+		ln, err = lc.Listen(context.Background(), "tcp", addr)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 上限を超えた接続は空きが出るまで Accept を待たせる
+	if config.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, config.MaxConnections)
+	}
+	return ln, nil
+}
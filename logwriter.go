@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// アクセスログをチャネル経由でバックグラウンドから書き出す Writer
+// リクエスト処理のゴルーチンがファイル書き込みを待たないようにする
+// log パッケージの出力も slog 経由でここに来るため、自身のエラーは標準エラーに出す
+type asyncWriter struct {
+	out          *bufio.Writer
+	lines        chan []byte
+	dropWhenFull bool
+	dropped      atomic.Int64
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newAsyncWriter(w io.Writer, size int, flushInterval time.Duration, dropWhenFull bool) *asyncWriter {
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	aw := &asyncWriter{
+		out:          bufio.NewWriter(w),
+		lines:        make(chan []byte, size),
+		dropWhenFull: dropWhenFull,
+		done:         make(chan struct{}),
+	}
+	go aw.run(flushInterval)
+	return aw
+}
+
+func (aw *asyncWriter) Write(p []byte) (int, error) {
+	// slog のハンドラはバッファを使い回すのでコピーしてから渡す
+	line := append([]byte(nil), p...)
+
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if aw.dropWhenFull {
+		select {
+		case aw.lines <- line:
+		default:
+			aw.dropped.Add(1)
+		}
+		return len(p), nil
+	}
+	aw.lines <- line
+	return len(p), nil
+}
+
+func (aw *asyncWriter) run(flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-aw.lines:
+			if !ok {
+				aw.flush()
+				close(aw.done)
+				return
+			}
+			if _, err := aw.out.Write(line); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write access log: %v\n", err)
+			}
+		case <-ticker.C:
+			aw.flush()
+		}
+	}
+}
+
+func (aw *asyncWriter) flush() {
+	if err := aw.out.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to flush access log: %v\n", err)
+	}
+	if n := aw.dropped.Swap(0); n > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d access log lines because the buffer was full\n", n)
+	}
+}
+
+// 残っているログをすべて書き出してから終了する
+func (aw *asyncWriter) Close() error {
+	aw.mu.Lock()
+	if !aw.closed {
+		aw.closed = true
+		close(aw.lines)
+	}
+	aw.mu.Unlock()
+	<-aw.done
+	return nil
+}
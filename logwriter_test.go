@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 書き込みを止めておける Writer
+type blockingWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriterFlushesOnClose(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	close(w.release)
+	aw := newAsyncWriter(w, 16, time.Hour, false)
+	for i := 0; i < 3; i++ {
+		aw.Write([]byte("line\n"))
+	}
+	aw.Close()
+	if got := w.buf.String(); got != strings.Repeat("line\n", 3) {
+		t.Errorf("got %q", got)
+	}
+	if _, err := aw.Write([]byte("late\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+}
+
+func TestAsyncWriterDropsWhenFull(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	// bufio.Writer は 4096 バイトまで書き込みをためるので、1 行でそれを超えて run を止める
+	aw := newAsyncWriter(w, 1, time.Hour, true)
+	big := bytes.Repeat([]byte("x"), 8192)
+	aw.Write(big)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			aw.Write([]byte("line\n"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked with dropWhenFull")
+	}
+	close(w.release)
+	aw.Close()
+	if got := strings.Count(w.buf.String(), "line\n"); got >= 10 {
+		t.Errorf("wrote %d of 10 lines, want some dropped", got)
+	}
+}
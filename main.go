@@ -5,29 +5,140 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 type Config struct {
-	Backends      map[string]string `json:"backends"`
-	Port          int               `json:"port"`
-	Port2         int               `json:"port2"`
-	SslCertPath   string            `json:"sslCertPath"`
-	SslKeyPath    string            `json:"sslKeyPath"`
-	HostWhitelist []string          `json:"hostWhitelist"`
+	Backends      map[string]Backend `json:"backends"`
+	Port          int                `json:"port"`
+	Port2         int                `json:"port2"`
+	SslCertPath   string             `json:"sslCertPath"`
+	SslKeyPath    string             `json:"sslKeyPath"`
+	HostWhitelist []string           `json:"hostWhitelist"`
+	Fingerprint   FingerprintConfig  `json:"fingerprint"`
+	DrainDelay    int                `json:"drainDelay"` // 秒
+	RouteBy       string             `json:"routeBy"`    // port のリスナー: host (既定) / sni
+	RouteBy2      string             `json:"routeBy2"`   // port2 のリスナー
+	Environment   string             `json:"environment"`
+	LogLevel      string             `json:"logLevel"` // info (既定) / debug
+	Region        string             `json:"region"`
+	ServerTiming  bool               `json:"serverTiming"` // 処理時間を Server-Timing ヘッダーで返す。本番では無効にしておく
+
+	HeaderValidation   string   `json:"headerValidation"` // off (既定) / reject / sanitize
+	DefaultContentType string   `json:"defaultContentType"`
+	MinHTTPVersion     string   `json:"minHttpVersion"` // "1.1" 以上などを指定すると古いリクエストを 505 で断る
+	ReusePort          bool     `json:"reusePort"`      // SO_REUSEPORT で複数プロセスが同じポートを使う
+	MaxConnections     int      `json:"maxConnections"` // port のリスナーで同時に受け付ける接続数
+	ClientCAPath       string   `json:"clientCaPath"`   // mTLS でクライアント証明書を検証する CA
+	RequireClientCert  bool     `json:"requireClientCert"`
+	RequestIDHeader    string   `json:"requestIdHeader"` // 既定は X-Request-ID
+	AdminToken         string   `json:"adminToken"`
+	AdminAllowedCIDRs  []string `json:"adminAllowedCIDRs"`  // 設定するとこの範囲からの管理リクエストだけを受け付ける
+	HideAdminEndpoints bool     `json:"hideAdminEndpoints"` // 拒否するときに 401 ではなく 404 を返す
+	MaintenancePage    string   `json:"maintenancePage"`    // メンテナンス中に返す HTML
+	ErrorPageTemplate  string   `json:"errorPageTemplate"`  // 502/504 のページ。{{.Status}} {{.StatusText}} {{.RequestID}} が使える
+
+	// タイムアウト (秒)。指定のないものは defaultTimeout を使う
+	DefaultTimeout int `json:"defaultTimeout"`
+	ReadTimeout    int `json:"readTimeout"`
+	WriteTimeout   int `json:"writeTimeout"`
+	IdleTimeout    int `json:"idleTimeout"`
+	RequestTimeout int `json:"requestTimeout"`
+
+	// ストリーミングのレスポンスに使うタイムアウト (秒)。0 の場合は打ち切らない
+	StreamingTimeout int `json:"streamingTimeout"`
+
+	// backends の数の上限。生成した設定が誤って膨らんだときに読み込みを断る。0 の場合は無制限
+	MaxRoutes int `json:"maxRoutes"`
+
+	// あるキーが別のキーの前方一致になっているときの扱い: ignore (既定) / warn / error
+	OnOverlappingRoutes string `json:"onOverlappingRoutes"`
+
+	// 起動時に自分自身へ各 backends のリクエストを送って結果をログに出す
+	SelfTest              bool `json:"selfTest"`
+	SelfTestExitOnFailure bool `json:"selfTestExitOnFailure"`
+
+	// バックエンドとクライアントの間で取り除くヘッダー
+	StripHopByHopHeaders StripHeadersConfig `json:"stripHopByHopHeaders"`
+
+	// 設定するとこのヘッダーで boot_id を返す
+	BootIDHeader string `json:"bootIdHeader"`
+
+	// 起動後この時間 (秒) は /_/health が 503 を返す
+	ReadinessDelay int `json:"readinessDelay"`
+
+	// Host がこのサーバー自身の IP アドレスのリクエストを /_/health と同じように扱う
+	// IP 直打ちで来るロードバランサのヘルスチェック向け。backends の振り分けより先に見る
+	IPHostHealthProbe bool `json:"ipHostHealthProbe"`
+
+	// バックエンドとの idle な接続を閉じるまでの時間 (秒)。0 の場合は Go の既定値 (90 秒)
+	BackendIdleConnTimeout int `json:"backendIdleConnTimeout"`
+
+	// バックエンドの名前解決のキャッシュ (秒)。0 の場合はキャッシュしない
+	DNSCacheTTL         int    `json:"dnsCacheTTL"`
+	DNSReresolveOnError bool   `json:"dnsReresolveOnError"`
+	ResolverAddress     string `json:"resolverAddress"` // バックエンドの名前解決に使う DNS サーバー ("10.0.0.2:53" など)
+	CheckBackendDNS     string `json:"checkBackendDns"` // 起動時にすべてのホスト名を引く: off (既定) / warn / fail
+
+	// user_uuid クッキーの有効期限とローテーション (秒)
+	UUIDCookieMaxAge        int `json:"uuidCookieMaxAge"`
+	UUIDCookieRotateAfter   int `json:"uuidCookieRotateAfter"`
+	UUIDCookieRotationGrace int `json:"uuidCookieRotationGrace"`
+
+	// 前段にある信頼できるプロキシの台数。X-Forwarded-For からクライアントの IP を取り出すのに使う
+	TrustedProxyHops  int      `json:"trustedProxyHops"`
+	TrustedProxyCIDRs []string `json:"trustedProxyCIDRs"` // 接続元がこの範囲のときだけ X-Forwarded-For を信じる。空なら信じない
+
+	// sslCertPath の証明書の期限がこの日数を切ったら警告する。既定は 30, 14, 7
+	CertExpiryWarnDays []int `json:"certExpiryWarnDays"`
+
+	// 受け付ける ALPN ("h2", "http/1.1", ALPN なしは "none")。空の場合は制限しない
+	AllowedALPN []string `json:"allowedAlpn"`
+
+	// 同時に進める TLS ハンドシェイクの数。0 の場合は制限しない
+	MaxConcurrentHandshakes int `json:"maxConcurrentHandshakes"`
+
+	// 接続元 IP ごとに同時に処理するリクエスト数。超えると 429 を返す。0 の場合は無制限
+	MaxRequestsPerIP    int    `json:"maxRequestsPerIP"`
+	RateLimitBody       string `json:"rateLimitBody"`
+	RateLimitRetryAfter int    `json:"rateLimitRetryAfter"` // 秒
+
+	// アクセスログの time の形式とタイムゾーン。未設定なら RFC3339 (ナノ秒) とローカル時刻
+	LogTimeFormat string `json:"logTimeFormat"`
+	LogTimezone   string `json:"logTimezone"` // "Asia/Tokyo" や "UTC"
+
+	// プロキシ自身が HTTP クライアントとしてたどるリダイレクトの上限 (mirrorTo など)
+	// 通常の転送ではリダイレクトをそのままクライアントに返す。0 の場合は 10
+	MaxUpstreamRedirects int `json:"maxUpstreamRedirects"`
+
+	// injectLatency などの障害注入を有効にする。本番でうっかり動かないよう既定は false
+	ChaosEnabled bool `json:"chaosEnabled"`
+
+	// フォワードプロキシ向けの絶対形式 (GET http://host/path) のリクエストを URL のホストで振り分ける
+	// false の場合は 400 を返す。このプロキシにフォワードプロキシの機能はない
+	AllowAbsoluteFormURIs bool `json:"allowAbsoluteFormURIs"`
+
+	// 設定するとログを OTLP/HTTP (JSON) でもこの URL に送る。"http://collector:4318/v1/logs" など
+	OTLPLogsEndpoint string `json:"otlpLogsEndpoint"`
+
+	// 0 の場合はリクエストごとに同期で書き込む
+	AccessLogBufferSize    int  `json:"accessLogBufferSize"`
+	AccessLogFlushInterval int  `json:"accessLogFlushInterval"` // ミリ秒
+	AccessLogDropWhenFull  bool `json:"accessLogDropWhenFull"`
 }
 
 var config Config
-var proxies = map[string]*httputil.ReverseProxy{}
+var routes = map[string]*route{}
 
 func loadConfigJson() {
 	// 設定を読み込む処理をここに追加
@@ -36,27 +147,73 @@ func loadConfigJson() {
 	if err != nil {
 		panic(err)
 	}
+	if err := applyConfigJson(bytes_); err != nil {
+		panic(err)
+	}
+}
 
-	// 設定をパースする
-	err = json.Unmarshal(bytes_, &config)
+// 新しい設定とルートをすべて組み立ててから差し替える
+// どこかで失敗したら何も変えずにエラーを返し、今の設定のまま動かし続ける
+func applyConfigJson(bytes_ []byte) error {
+	next, err := parseConfigJson(bytes_)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	page, err := parseErrorPage(next.ErrorPageTemplate)
+	if err != nil {
+		return fmt.Errorf("errorPageTemplate: %w", err)
 	}
 
-	// 各ルートの設定
-	for key, value := range config.Backends {
-		proxyURL, err := url.Parse(value)
-		if err != nil {
-			log.Fatal(err)
+	nextRoutes, err := buildRoutes(&next, routes)
+	if err != nil {
+		return err
+	}
+	config = next
+	errorPage = page
+	routes = nextRoutes
+	return nil
+}
+
+// 検査してから空の Config に読み込む
+// 前の設定に重ねると消したキーや defaultTimeout で埋めた値が残るので、毎回新しく作る
+func parseConfigJson(bytes_ []byte) (Config, error) {
+	var next Config
+	if err := checkDuplicateJSONKeys(bytes_); err != nil {
+		return next, err
+	}
+	if err := json.Unmarshal(bytes_, &next); err != nil {
+		return next, err
+	}
+	if next.MaxRoutes > 0 && len(next.Backends) > next.MaxRoutes {
+		return next, fmt.Errorf("config has %d backends, exceeds maxRoutes %d", len(next.Backends), next.MaxRoutes)
+	}
+	if err := checkOverlappingRoutes(next); err != nil {
+		return next, err
+	}
+	if next.MinHTTPVersion != "" {
+		if _, _, ok := http.ParseHTTPVersion("HTTP/" + next.MinHTTPVersion); !ok {
+			return next, fmt.Errorf("invalid minHttpVersion %q", next.MinHTTPVersion)
 		}
+	}
+	applyDefaultTimeouts(&next)
+	return next, nil
+}
 
-		proxy := httputil.NewSingleHostReverseProxy(proxyURL)
-		proxy.ModifyResponse = func(response *http.Response) error {
-			response.Header.Set("X-Your-Custom-Header", "Value")
-			return nil
+// 設定から消えた backends はここで振り分け先からも消える
+// /_/maintenance で切り替えた状態は、ファイルの maintenance が変わっていなければ引き継ぐ
+func buildRoutes(cfg *Config, prev map[string]*route) (map[string]*route, error) {
+	next := make(map[string]*route, len(cfg.Backends))
+	for key, value := range cfg.Backends {
+		rt, err := newRoute(value, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", key, err)
+		}
+		if old, ok := prev[key]; ok && old.backend.Maintenance == value.Maintenance {
+			rt.maintenance.Store(old.maintenance.Load())
 		}
-		proxies[key] = proxy
+		next[key] = rt
 	}
+	return next, nil
 }
 
 // レスポンスをラップするための構造体
@@ -71,96 +228,308 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+// http.ResponseController から Flush などを使えるようにする
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// プロセスごとに変わる ID。再起動の前後でどちらのプロセスが処理したかを見分ける
+var bootID = uuid.New().String()
+
+// すべてのログに付ける環境情報。環境変数が設定されていればそちらを優先する
+func staticLogAttrs() []any {
+	attrs := []any{slog.String("boot_id", bootID)}
+	environment := config.Environment
+	if v := os.Getenv("TINY_PROXY_ENVIRONMENT"); v != "" {
+		environment = v
+	}
+	if environment != "" {
+		attrs = append(attrs, slog.String("environment", environment))
+	}
+	region := config.Region
+	if v := os.Getenv("TINY_PROXY_REGION"); v != "" {
+		region = v
+	}
+	if region != "" {
+		attrs = append(attrs, slog.String("region", region))
+	}
+	return attrs
+}
+
+func logLevel() slog.Level {
+	if config.LogLevel == "debug" {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// logTimeFormat / logTimezone に合わせて time 属性を書き換える
+// rfc3339 / rfc3339nano / epochMillis / epochSeconds のほか、Go のレイアウト文字列も使える
+func logTimeReplacer() (func([]string, slog.Attr) slog.Attr, error) {
+	if config.LogTimeFormat == "" && config.LogTimezone == "" {
+		return nil, nil
+	}
+	loc := time.Local
+	if config.LogTimezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(config.LogTimezone); err != nil {
+			return nil, fmt.Errorf("invalid logTimezone %q: %w", config.LogTimezone, err)
+		}
+	}
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) > 0 || a.Key != slog.TimeKey || a.Value.Kind() != slog.KindTime {
+			return a
+		}
+		t := a.Value.Time().In(loc)
+		switch config.LogTimeFormat {
+		case "", "rfc3339nano":
+			return slog.String(slog.TimeKey, t.Format(time.RFC3339Nano))
+		case "rfc3339":
+			return slog.String(slog.TimeKey, t.Format(time.RFC3339))
+		case "epochMillis":
+			return slog.Int64(slog.TimeKey, t.UnixMilli())
+		case "epochSeconds":
+			return slog.Int64(slog.TimeKey, t.Unix())
+		}
+		return slog.String(slog.TimeKey, t.Format(config.LogTimeFormat))
+	}, nil
+}
+
+// config.json を読み直す
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	// 起動時と違い、ファイルが読めないときは今の設定のまま動かし続ける
+	bytes_, err := os.ReadFile("config.json")
+	if err != nil {
+		recordReload(err)
+		log.Printf("Config reload skipped, keeping the current config: %v", err)
+		http.Error(w, "config.json is not readable", http.StatusInternalServerError)
+		return
+	}
+	err = applyConfigJson(bytes_)
+	recordReload(err)
+	if err != nil {
+		log.Printf("Config reload rejected, keeping the current config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// backends の振り分け先に転送し、アクセスログを書く
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	reqHeaderCount := headerCount(r.Header) // 受け取ったときの数。転送用に足すものは含めない
+	if config.BootIDHeader != "" {
+		w.Header().Set(config.BootIDHeader, bootID)
+	}
+	if r.URL.IsAbs() {
+		if !config.AllowAbsoluteFormURIs {
+			log.Printf("Rejected request from %s: absolute-form request URI %s", r.RemoteAddr, r.RequestURI)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		normalizeAbsoluteForm(r)
+	}
+	if config.IPHostHealthProbe && isOwnIPHost(r) {
+		handleHealth(w, r)
+		return
+	}
+	host, ok := routingHost(r)
+	if !ok {
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	key, ok := matchRoute(host)
+	if !ok {
+		return
+	}
+	// リロードで routes が差し替わっても、このリクエストは見つけたルートで最後まで処理する
+	rt, ok := routes[key]
+	if !ok {
+		return
+	}
+	realIP := clientIP(r)
+	if config.MaxRequestsPerIP > 0 {
+		if !perIPLimiter.acquire(realIP) {
+			log.Printf("Rejected request from %s: too many concurrent requests", realIP)
+			writeRateLimited(w)
+			return
+		}
+		defer perIPLimiter.release(realIP)
+	}
+	if !meetsMinHTTPVersion(r) {
+		http.Error(w, "HTTP Version Not Supported", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if anomaly := ambiguousFraming(r); anomaly != "" {
+		log.Printf("Rejected request from %s: %s", r.RemoteAddr, anomaly)
+		// 続くバイトの区切りも信用できないので接続ごと閉じる
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !validateHeaderValues(r) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	userID, rotatedFrom := userUUID(w, r)
+	reqID := requestID(r)
+	traceID := ""
+	if rt.backend.PropagateTraceparent {
+		traceID = propagateTraceparent(r)
+	}
+
+	// X-Forwarded-For ヘッダーを更新または設定
+	// クライアントのIPアドレスを取得
+	clientIP := r.RemoteAddr
+	if ip := strings.Split(clientIP, ":"); len(ip) > 0 {
+		clientIP = ip[0]
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		clientIP = xff + ", " + clientIP
+	}
+	r.Header.Set("X-Forwarded-For", clientIP)
+
+	lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	r, cancel := withRequestTimeout(lrw, r, rt.backend.Streaming)
+	defer cancel()
+	r, trace := withUpstreamTrace(r, start)
+	// ReverseProxy が本文のコピー中に ErrAbortHandler で抜けてもアクセスログは残す
+	defer func() {
+		aborted := recover()
+		recordRequest(rt, lrw.statusCode)
+		outcome := requestOutcome(r, trace)
+		if aborted != nil {
+			outcome = "aborted"
+		}
+		attrs := []slog.Attr{
+			slog.String("uuid", userID),
+			slog.String("request_id", reqID),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", lrw.statusCode),
+			slog.String("match_mode", routeMatchMode),
+			slog.String("match_pattern", key),
+			slog.String("outcome", outcome),
+			slog.Int("req_header_count", reqHeaderCount),
+			slog.Int("resp_header_count", headerCount(lrw.Header())),
+		}
+		if trace.gotConn {
+			attrs = append(attrs, slog.Bool("conn_reused", trace.connReused))
+		}
+		if fingerprint, ok := clientCertFingerprint(r); ok {
+			attrs = append(attrs, slog.String("tls_client_cert_sha256", fingerprint))
+		}
+		if config.TrustedProxyHops > 0 {
+			attrs = append(attrs, slog.String("client_ip", realIP))
+		}
+		if traceID != "" {
+			attrs = append(attrs, slog.String("trace_id", traceID))
+		}
+		if rotatedFrom != "" {
+			attrs = append(attrs, slog.String("rotated_from", rotatedFrom))
+		}
+		if config.Fingerprint.Enabled {
+			attrs = append(attrs, slog.String("fingerprint", requestFingerprint(r, realIP, config.Fingerprint)))
+		}
+		slog.LogAttrs(context.Background(), slog.LevelInfo, "", attrs...)
+		if aborted != nil {
+			panic(aborted)
+		}
+	}()
+	rt.ServeHTTP(lrw, r)
+}
+
 func main() {
 	fp, err := os.OpenFile("access.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		panic(err)
 	}
-	logger := slog.New(slog.NewJSONHandler(fp, nil))
-	slog.SetDefault(logger)
 
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	loadConfigJson()
+	if err := checkBackendDNS(); err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/_/reload", func(w http.ResponseWriter, r *http.Request) {
-		loadConfigJson()
-		w.Write([]byte("ok"))
-	})
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		for key := range proxies {
-			host := r.Host
+	var accessLog io.WriteCloser = fp
+	if config.AccessLogBufferSize > 0 {
+		flushInterval := time.Duration(config.AccessLogFlushInterval) * time.Millisecond
+		accessLog = newAsyncWriter(fp, config.AccessLogBufferSize, flushInterval, config.AccessLogDropWhenFull)
+	}
+	replaceTime, err := logTimeReplacer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var handler slog.Handler = slog.NewJSONHandler(accessLog, &slog.HandlerOptions{Level: logLevel(), ReplaceAttr: replaceTime})
+	var otlp *otlpExporter
+	if config.OTLPLogsEndpoint != "" {
+		otlp = newOTLPExporter(config.OTLPLogsEndpoint)
+		handler = teeHandler{handler, &otlpHandler{exporter: otlp, level: logLevel()}}
+	}
+	logger := slog.New(handler).With(staticLogAttrs()...)
+	slog.SetDefault(logger)
 
-			// クッキーからUUIDを取得、なければ新しいUUIDを生成して設定
-			uuidCookie, err := r.Cookie("user_uuid")
-			if err != nil {
-				newUUID := uuid.New().String()
-				http.SetCookie(w, &http.Cookie{Name: "user_uuid", Value: newUUID, Path: "/"})
-				uuidCookie = &http.Cookie{Value: newUUID}
-			}
+	http.HandleFunc("/_/reload", requireAdminIfConfigured(handleReload))
+	http.HandleFunc("/_/health", handleHealth)
+	http.HandleFunc("/_/live", handleLive)
+	http.HandleFunc("/_/maintenance", requireAdmin(handleMaintenance))
+	http.HandleFunc("/_/backends/drain", requireAdmin(handleBackendDrain))
+	http.HandleFunc("/_/dashboard", requireAdmin(handleDashboard))
+	http.HandleFunc("/_/status", requireAdmin(handleStatus))
+	http.HandleFunc("/_/metrics", requireAdminIfConfigured(handleMetrics))
 
-			// X-Forwarded-For ヘッダーを更新または設定
-			// クライアントのIPアドレスを取得
-			clientIP := r.RemoteAddr
-			if ip := strings.Split(clientIP, ":"); len(ip) > 0 {
-				clientIP = ip[0]
-			}
-			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-				clientIP = xff + ", " + clientIP
-			}
-			r.Header.Set("X-Forwarded-For", clientIP)
-
-			lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-			if strings.HasPrefix(host, key) {
-				proxy := proxies[key]
-				proxy.ServeHTTP(lrw, r)
-				slog.LogAttrs(
-					context.Background(),
-					slog.LevelInfo,
-					"",
-					slog.String("uuid", uuidCookie.Value),
-					slog.String("remote_addr", r.RemoteAddr),
-					slog.String("method", r.Method),
-					slog.String("host", r.Host),
-					slog.String("path", r.URL.Path),
-					slog.Int("status", lrw.statusCode),
-				)
-				return
-			}
-		}
-	})
+	http.HandleFunc("/", handleProxy)
 
 	log.Println("log file: access.log")
+	log.Printf("Boot ID: %s", bootID)
+	if config.ChaosEnabled {
+		log.Println("Chaos injection is enabled")
+	}
 	if config.SslCertPath == "" || config.SslKeyPath == "" {
 		fmt.Println("SSL Cert: Let's Encrypt")
 		fmt.Println("certManager.....")
+		certCache := autocert.DirCache("certs")
 		certManager := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			Cache:      autocert.DirCache("certs"),
+			Cache:      loggingCertCache{certCache},
 			HostPolicy: autocert.HostWhitelist(config.HostWhitelist...), // 実際のドメイン名に置き換え
 		}
 
 		// HTTPサーバーを80番ポートで起動し、チャレンジリクエストを処理
+		http.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
+			log.Printf("Received ACME challenge request for %s", r.URL.Path)
+			certManager.HTTPHandler(nil).ServeHTTP(w, r)
+		})
+		httpServer := &http.Server{
+			Addr:        fmt.Sprintf(":%d", config.Port2),
+			Handler:     withRouteBy(http.DefaultServeMux, config.RouteBy2),
+			ConnContext: framingConnContext,
+		}
+		applyServerTimeouts(httpServer)
 		go func() {
-			http.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
-				log.Printf("Received ACME challenge request for %s", r.URL.Path)
-				certManager.HTTPHandler(nil).ServeHTTP(w, r)
-			})
 			log.Printf(fmt.Sprintf("Listening http on port :%d", config.Port2))
-			err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port2), nil)
+			ln, err := net.Listen("tcp", httpServer.Addr)
 			if err != nil {
 				log.Fatalf("HTTP server for ACME challenge failed: %v", err)
 			}
+			err = httpServer.Serve(newFramingListener(ln))
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("HTTP server for ACME challenge failed: %v", err)
+			}
 		}()
 
 		// GetCertificate メソッドをラップしてログを追加
 		getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			log.Printf("Attempting to get certificate for: %s", hello.ServerName)
-			cert, err := certManager.GetCertificate(hello)
+			cert, source, err := getCertificateCounted(&certManager, hello)
 			if err != nil {
 				log.Printf("Failed to get certificate for %s: %v", hello.ServerName, err)
 			} else {
-				log.Printf("Successfully got certificate for %s", hello.ServerName)
+				log.Printf("Successfully got certificate for %s (%s)", hello.ServerName, source)
 			}
 			return cert, err
 		}
@@ -168,16 +537,61 @@ func main() {
 		log.Println("https server.....")
 		log.Printf(fmt.Sprintf("Listening https on port :%d", config.Port))
 		server := &http.Server{
-			Addr: fmt.Sprintf(":%d", config.Port),
+			Addr:    fmt.Sprintf(":%d", config.Port),
+			Handler: withRouteBy(http.DefaultServeMux, config.RouteBy),
 			TLSConfig: &tls.Config{
 				// GetCertificate: certManager.GetCertificate,
 				GetCertificate: getCertificate,
 			},
 		}
-		log.Fatal(server.ListenAndServeTLS("", "")) // Let's Encryptが自動的に証明書を管理
+		if err := configureTLS(server.TLSConfig); err != nil {
+			log.Fatal(err)
+		}
+		applyServerTimeouts(server)
+		ln, err := listen(server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			err := serveTLS(server, ln, "", "") // Let's Encryptが自動的に証明書を管理
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		if config.SelfTest {
+			go runSelfTest(certCache) // loggingCertCache を通すと取得の回数に数えてしまう
+		}
+		waitForShutdown(server, httpServer)
 	} else {
 		fmt.Println("SSL Cert: ", config.SslCertPath)
+		go watchCertExpiry(config.SslCertPath)
 		log.Printf(fmt.Sprintf("Listening https on port :%d", config.Port))
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", config.Port), config.SslCertPath, config.SslKeyPath, nil))
+		server := &http.Server{
+			Addr:      fmt.Sprintf(":%d", config.Port),
+			Handler:   withRouteBy(http.DefaultServeMux, config.RouteBy),
+			TLSConfig: &tls.Config{},
+		}
+		if err := configureTLS(server.TLSConfig); err != nil {
+			log.Fatal(err)
+		}
+		applyServerTimeouts(server)
+		ln, err := listen(server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			err := serveTLS(server, ln, config.SslCertPath, config.SslKeyPath)
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		if config.SelfTest {
+			go runSelfTest(nil)
+		}
+		waitForShutdown(server)
+	}
+	if otlp != nil {
+		otlp.Close()
 	}
+	accessLog.Close()
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// テスト中の slog と log.Printf の出力をここに集める
+var testLog syncBuffer
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&testLog, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	os.Exit(m.Run())
+}
+
+// テストのあいだだけ設定とルートを差し替える
+func useConfig(t *testing.T, configJSON string) {
+	t.Helper()
+	prevConfig, prevRoutes, prevErrorPage := config, routes, errorPage
+	t.Cleanup(func() { config, routes, errorPage = prevConfig, prevRoutes, prevErrorPage })
+	if err := applyConfigJson([]byte(configJSON)); err != nil {
+		t.Fatalf("applyConfigJson: %v", err)
+	}
+	testLog.Reset()
+}
+
+// app.test 宛てのリクエスト
+func appRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.Host = "app.test"
+	return r
+}
+
+// apiKeyHashes に書く値
+func sha256Hex(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func serveProxy(r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleProxy(rec, r)
+	return rec
+}
+
+// ログの行を JSON として読む。msg が空の行がアクセスログ
+func logEntries(t *testing.T) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(testLog.String()))
+	for scanner.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %s", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func lastAccessLog(t *testing.T) map[string]any {
+	t.Helper()
+	entries := logEntries(t)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i]["msg"] == "" {
+			return entries[i]
+		}
+	}
+	t.Fatal("no access log line")
+	return nil
+}
+
+func TestApplyConfigJsonRoutesRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+
+	rec := serveProxy(appRequest("GET", "/hello", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "backend /hello" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	entry := lastAccessLog(t)
+	if entry["path"] != "/hello" || entry["status"] != float64(http.StatusOK) {
+		t.Errorf("access log = %v", entry)
+	}
+}
+
+func TestStaticLogAttrs(t *testing.T) {
+	useConfig(t, `{"environment": "staging", "region": "ap-northeast-1"}`)
+	t.Setenv("TINY_PROXY_REGION", "us-east-1")
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).With(staticLogAttrs()...).Info("hello")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	// 環境変数が設定より優先される
+	if entry["environment"] != "staging" || entry["region"] != "us-east-1" || entry["boot_id"] != bootID {
+		t.Errorf("log line = %v", entry)
+	}
+}
+
+// config.json を置いた一時ディレクトリで動かす。contents が空ならファイルを置かない
+func chdirWithConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if contents != "" {
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func reload() *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleReload(rec, httptest.NewRequest("POST", "/_/reload", nil))
+	return rec
+}
+
+func TestReloadKeepsConfigWhenFileIsMissing(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	chdirWithConfig(t, "")
+
+	if rec := reload(); rec.Code != http.StatusInternalServerError {
+		t.Errorf("reload without config.json: got %d", rec.Code)
+	}
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Errorf("after failed reload: got %d", rec.Code)
+	}
+}
+
+func TestReloadKeepsConfigOnInvalidFile(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "maintenancePage": "old"}`)
+	for name, contents := range map[string]string{
+		"broken JSON":    `{"backends": `,
+		"error page":     `{"backends": {"app.test": "` + backend.URL + `"}, "errorPageTemplate": "{{.Status", "maintenancePage": "new"}`,
+		"invalid route":  `{"backends": {"app.test": {"url": "` + backend.URL + `", "loadBalancing": "random"}}, "maintenancePage": "new"}`,
+		"invalid method": `{"backends": {"app.test": {"url": "` + backend.URL + `", "methodRewrite": {"GET": "FETCH"}}}, "maintenancePage": "new"}`,
+	} {
+		chdirWithConfig(t, contents)
+		if rec := reload(); rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: reload got %d", name, rec.Code)
+		}
+		if config.MaintenancePage != "old" || serveProxy(appRequest("GET", "/", nil)).Code != http.StatusOK {
+			t.Errorf("%s: the current config was changed", name)
+		}
+	}
+
+	chdirWithConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "maintenancePage": "new"}`)
+	if rec := reload(); rec.Code != http.StatusOK || config.MaintenancePage != "new" {
+		t.Errorf("valid reload: got %d, maintenancePage %q", rec.Code, config.MaintenancePage)
+	}
+}
+
+func TestMaxRoutes(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "maxRoutes": 2}`)
+
+	over := `{"backends": {"a.test": "` + backend.URL + `", "b.test": "` + backend.URL + `", "c.test": "` + backend.URL + `"}, "maxRoutes": 2}`
+	if err := applyConfigJson([]byte(over)); err == nil || !strings.Contains(err.Error(), "exceeds maxRoutes 2") {
+		t.Fatalf("config over maxRoutes: err = %v", err)
+	}
+	if len(routes) != 1 || routes["app.test"] == nil || len(config.Backends) != 1 {
+		t.Errorf("rejected config was applied: routes %v", routes)
+	}
+}
+
+func TestBuildRoutesUsesTheNewConfig(t *testing.T) {
+	useConfig(t, `{"backendIdleConnTimeout": 5}`)
+	next, err := parseConfigJson([]byte(`{"backendIdleConnTimeout": 7, "backends": {"app.test": "http://127.0.0.1:1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 組み立てている間も、リクエストからは今の設定が見える
+	built, err := buildRoutes(&next, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := baseTransport(built["app.test"].proxies[0].Transport).IdleConnTimeout; got != 7*time.Second {
+		t.Errorf("idle timeout = %v, want the new 7s", got)
+	}
+	if config.BackendIdleConnTimeout != 5 {
+		t.Errorf("global config changed to %d while building routes", config.BackendIdleConnTimeout)
+	}
+}
+
+func TestReloadRemovesDeletedBackends(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`", "old.test": "`+backend.URL+`"}}`)
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": "` + backend.URL + `"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := routes["old.test"]; ok {
+		t.Error("deleted backend is still routed")
+	}
+	r := appRequest("GET", "/", nil)
+	r.Host = "old.test"
+	if rec := serveProxy(r); rec.Body.String() == "ok" {
+		t.Error("request to a deleted backend reached it")
+	}
+}
+
+func TestLogTimeReplacer(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	for _, tt := range []struct {
+		format, timezone string
+		want             any
+	}{
+		{"rfc3339", "Asia/Tokyo", "2024-01-02T12:04:05+09:00"},
+		{"", "UTC", "2024-01-02T03:04:05.6Z"},
+		{"epochMillis", "", float64(at.UnixMilli())},
+		{"epochSeconds", "", float64(at.Unix())},
+		{"2006/01/02 15:04", "UTC", "2024/01/02 03:04"},
+	} {
+		useConfig(t, `{"logTimeFormat": "`+tt.format+`", "logTimezone": "`+tt.timezone+`"}`)
+		replace, err := logTimeReplacer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: replace})
+		handler.Handle(context.Background(), slog.NewRecord(at, slog.LevelInfo, "", 0))
+		var entry map[string]any
+		json.Unmarshal(buf.Bytes(), &entry)
+		if entry["time"] != tt.want {
+			t.Errorf("format %q timezone %q: time = %v, want %v", tt.format, tt.timezone, entry["time"], tt.want)
+		}
+	}
+
+	useConfig(t, `{"logTimezone": "Mars/Olympus"}`)
+	if _, err := logTimeReplacer(); err == nil {
+		t.Error("unknown logTimezone was accepted")
+	}
+}
+
+func TestBootIDHeader(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "bootIdHeader": "X-Boot-Id"}`)
+	if got := serveProxy(appRequest("GET", "/", nil)).Header().Get("X-Boot-Id"); got != bootID || got == "" {
+		t.Errorf("X-Boot-Id = %q, want %q", got, bootID)
+	}
+
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	if got := serveProxy(appRequest("GET", "/", nil)).Header().Get("X-Boot-Id"); got != "" {
+		t.Errorf("boot ID sent without bootIdHeader: %q", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// /_/metrics で Prometheus のテキスト形式で返す値
+var (
+	reloadAttempts    atomic.Int64
+	reloadSuccesses   atomic.Int64
+	reloadFailures    atomic.Int64
+	lastReloadSuccess atomic.Int64 // UnixNano。0 はまだ成功していない
+
+	// autocert の GetCertificate がキャッシュから返したか、新しく取得したか
+	certCacheHits    atomic.Int64
+	certAcquisitions atomic.Int64
+)
+
+func recordReload(err error) {
+	reloadAttempts.Add(1)
+	if err != nil {
+		reloadFailures.Add(1)
+		return
+	}
+	reloadSuccesses.Add(1)
+	lastReloadSuccess.Store(time.Now().UnixNano())
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "tiny_proxy_config_reload_attempts_total", "counter", "Config reloads requested via /_/reload.", float64(reloadAttempts.Load()))
+	writeMetric(w, "tiny_proxy_config_reload_successes_total", "counter", "Config reloads that were applied.", float64(reloadSuccesses.Load()))
+	writeMetric(w, "tiny_proxy_config_reload_failures_total", "counter", "Config reloads that were rejected.", float64(reloadFailures.Load()))
+	writeMetric(w, "tiny_proxy_config_last_reload_success_timestamp_seconds", "gauge", "Unix time of the last successful config reload.", float64(lastReloadSuccess.Load())/float64(time.Second))
+	writeMetric(w, "tiny_proxy_autocert_cache_hits_total", "counter", "TLS handshakes served a cached autocert certificate.", float64(certCacheHits.Load()))
+	writeMetric(w, "tiny_proxy_autocert_acquisitions_total", "counter", "TLS handshakes that triggered an autocert certificate acquisition.", float64(certAcquisitions.Load()))
+}
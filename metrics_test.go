@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// /_/metrics の値を名前ごとに読む
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/_/metrics", nil))
+	metrics := map[string]float64{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("metric line %q: %v", line, err)
+		}
+		metrics[name] = v
+	}
+	return metrics
+}
+
+func TestReloadMetrics(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	before := scrapeMetrics(t)
+
+	start := time.Now()
+	chdirWithConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	reload()
+	chdirWithConfig(t, `{"backends": `)
+	reload()
+	chdirWithConfig(t, "")
+	reload()
+
+	after := scrapeMetrics(t)
+	for name, want := range map[string]float64{
+		"tiny_proxy_config_reload_attempts_total":  3,
+		"tiny_proxy_config_reload_successes_total": 1,
+		"tiny_proxy_config_reload_failures_total":  2,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s increased by %g, want %g", name, got, want)
+		}
+	}
+	last := after["tiny_proxy_config_last_reload_success_timestamp_seconds"]
+	if last < float64(start.Unix()) || last > float64(time.Now().Unix()+1) {
+		t.Errorf("last reload success = %g, started at %d", last, start.Unix())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var mirrorClient = &http.Client{Timeout: 10 * time.Second, CheckRedirect: checkUpstreamRedirect}
+
+// maxUpstreamRedirects を超えたらリダイレクトをたどるのをやめてエラーにする
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	limit := config.MaxUpstreamRedirects
+	if limit <= 0 {
+		limit = 10
+	}
+	if len(via) > limit {
+		log.Printf("Stopped following redirects from %s after %d hops: %s", via[0].URL, limit, req.URL)
+		return fmt.Errorf("stopped after %d redirects", limit)
+	}
+	return nil
+}
+
+// 本文を読みながら mirrorBodyBytes まで写しを取っておく
+type teeBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// リクエストの写しを mirrorTo に送る準備をする
+// 戻り値の関数は本来のレスポンスを返した後に呼び、送信はバックグラウンドで行う
+func startMirror(r *http.Request, backend Backend) func() {
+	method := r.Method
+	target := strings.TrimSuffix(backend.MirrorTo, "/") + r.URL.RequestURI()
+	// ミラー先は別の環境のことが多いので、利用者の資格情報は渡さない
+	header := r.Header.Clone()
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie", backend.APIKeyHeader} {
+		if name != "" {
+			header.Del(name)
+		}
+	}
+
+	var body *teeBody
+	if backend.MirrorBodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+		body = &teeBody{ReadCloser: r.Body, limit: backend.MirrorBodyBytes}
+		r.Body = body
+	}
+
+	return func() {
+		var payload []byte
+		if body != nil && !body.overflow {
+			payload = body.buf.Bytes()
+		}
+		go func() {
+			req, err := http.NewRequestWithContext(context.Background(), method, target, bytes.NewReader(payload))
+			if err != nil {
+				return
+			}
+			req.Header = header
+			req.Header.Del("Content-Length")
+			// ミラー先のレスポンスやエラーは無視する
+			resp, err := mirrorClient.Do(req)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+}
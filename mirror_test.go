@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mirroredRequest struct {
+	method, path, body string
+	header             http.Header
+}
+
+func TestMirrorStripsCredentials(t *testing.T) {
+	backend := textBackend(t, "ok")
+	mirrored := make(chan mirroredRequest, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.URL.RequestURI(), string(body), r.Header}
+	}))
+	defer mirror.Close()
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {
+		"url": %q, "mirrorTo": %q, "mirrorBodyBytes": 100,
+		"apiKeyHeader": "X-API-Key", "apiKeyHashes": [%q]
+	}}}`, backend.URL, mirror.URL, sha256Hex("key")))
+
+	r := appRequest("POST", "/orders?id=1", strings.NewReader("payload"))
+	r.Header.Set("Authorization", "Bearer token")
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("X-API-Key", "key")
+	r.Header.Set("X-Trace", "t")
+	if rec := serveProxy(r); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case got := <-mirrored:
+		if got.method != "POST" || got.path != "/orders?id=1" || got.body != "payload" || got.header.Get("X-Trace") != "t" {
+			t.Errorf("mirrored %+v", got)
+		}
+		for _, name := range []string{"Authorization", "Cookie", "X-API-Key"} {
+			if v := got.header.Get(name); v != "" {
+				t.Errorf("mirrored request has %s: %q", name, v)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+}
+
+func TestMaxUpstreamRedirects(t *testing.T) {
+	var hits atomic.Int64
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Redirect(w, r, "/again", http.StatusFound)
+	}))
+	defer loop.Close()
+
+	for _, tt := range []struct {
+		config string
+		hits   int64
+	}{
+		{`{"maxUpstreamRedirects": 2}`, 3},
+		{`{}`, 11},
+	} {
+		useConfig(t, tt.config)
+		hits.Store(0)
+		if _, err := mirrorClient.Get(loop.URL); err == nil {
+			t.Errorf("%s: redirect loop did not fail", tt.config)
+		}
+		if got := hits.Load(); got != tt.hits {
+			t.Errorf("%s: followed to %d requests, want %d", tt.config, got, tt.hits)
+		}
+	}
+	if len(logsWithMessage(t, "Stopped following redirects from "+loop.URL+" after 10 hops: "+loop.URL+"/again")) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// アクセスログを OTLP/HTTP (JSON) でも送る slog.Handler
+// SDK は使わず、/v1/logs にまとめて POST する。送信が詰まってバッファがあふれたら、リクエストを待たせずに捨てる
+type otlpHandler struct {
+	exporter *otlpExporter
+	level    slog.Level
+	attrs    []otlpKeyValue
+	prefix   string // WithGroup で付くキーの接頭辞
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// OTLP の JSON では int64 を文字列で表す
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+func (h *otlpHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *otlpHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]otlpKeyValue(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendOTLPAttr(attrs, h.prefix, a)
+		return true
+	})
+	msg := r.Message
+	h.exporter.enqueue(otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+		SeverityNumber: otlpSeverity(r.Level),
+		SeverityText:   r.Level.String(),
+		Body:           otlpAnyValue{StringValue: &msg},
+		Attributes:     attrs,
+	})
+	return nil
+}
+
+func (h *otlpHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]otlpKeyValue(nil), h.attrs...)
+	for _, a := range as {
+		h2.attrs = appendOTLPAttr(h2.attrs, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *otlpHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// slog のグループは "group.key" のように平らにする
+func appendOTLPAttr(attrs []otlpKeyValue, prefix string, a slog.Attr) []otlpKeyValue {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			attrs = appendOTLPAttr(attrs, prefix, ga)
+		}
+		return attrs
+	}
+	if a.Key == "" {
+		return attrs
+	}
+	var av otlpAnyValue
+	switch v.Kind() {
+	case slog.KindInt64:
+		s := strconv.FormatInt(v.Int64(), 10)
+		av.IntValue = &s
+	case slog.KindUint64:
+		s := strconv.FormatUint(v.Uint64(), 10)
+		av.IntValue = &s
+	case slog.KindFloat64:
+		f := v.Float64()
+		av.DoubleValue = &f
+	case slog.KindBool:
+		b := v.Bool()
+		av.BoolValue = &b
+	case slog.KindTime:
+		s := v.Time().Format(time.RFC3339Nano)
+		av.StringValue = &s
+	default:
+		s := v.String()
+		av.StringValue = &s
+	}
+	return append(attrs, otlpKeyValue{Key: prefix + a.Key, Value: av})
+}
+
+// OpenTelemetry の SeverityNumber (DEBUG=5, INFO=9, WARN=13, ERROR=17)
+func otlpSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 17
+	case level >= slog.LevelWarn:
+		return 13
+	case level >= slog.LevelInfo:
+		return 9
+	}
+	return 5
+}
+
+const otlpBatchSize = 512
+
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	records  chan otlpLogRecord
+	dropped  atomic.Int64
+
+	// Close の後もバックグラウンドのゴルーチンからログが来るので、閉じたチャネルには送らない
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second, CheckRedirect: checkUpstreamRedirect},
+		records:  make(chan otlpLogRecord, 4096),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) enqueue(rec otlpLogRecord) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.records <- rec:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var batch []otlpLogRecord
+	for {
+		select {
+		case rec, ok := <-e.records:
+			if !ok {
+				e.export(batch)
+				close(e.done)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= otlpBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// 自分のエラーを slog に流すと送り先が落ちている間ずっと増え続けるので、標準エラーに出す
+func (e *otlpExporter) export(batch []otlpLogRecord) {
+	if n := e.dropped.Swap(0); n > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d OTLP log records because the buffer was full\n", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	serviceName := "tiny_proxy"
+	payload := map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}},
+			},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "tiny_proxy"},
+				"logRecords": batch,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode OTLP logs: %v\n", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export OTLP logs: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "Failed to export OTLP logs: status %d\n", resp.StatusCode)
+	}
+}
+
+// 残っているレコードを送ってから終了する
+func (e *otlpExporter) Close() error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.records)
+	}
+	e.mu.Unlock()
+	<-e.done
+	return nil
+}
+
+// ファイルと OTLP の両方に書く
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	hs := make(teeHandler, len(t))
+	for i, h := range t {
+		hs[i] = h.WithAttrs(attrs)
+	}
+	return hs
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	hs := make(teeHandler, len(t))
+	for i, h := range t {
+		hs[i] = h.WithGroup(name)
+	}
+	return hs
+}
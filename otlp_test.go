@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type otlpPayload struct {
+	ResourceLogs []struct {
+		ScopeLogs []struct {
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+// 受け取ったログレコードをためておくコレクター
+func otlpCollector(t *testing.T) (*httptest.Server, func() []otlpLogRecord) {
+	t.Helper()
+	var mu sync.Mutex
+	var records []otlpLogRecord
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload otlpPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("collector got invalid JSON: %s", body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rl := range payload.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				records = append(records, sl.LogRecords...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	return collector, func() []otlpLogRecord {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]otlpLogRecord(nil), records...)
+	}
+}
+
+func attrValue(attrs []otlpKeyValue, key string) (otlpAnyValue, bool) {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return otlpAnyValue{}, false
+}
+
+func TestOTLPExporter(t *testing.T) {
+	collector, received := otlpCollector(t)
+	exporter := newOTLPExporter(collector.URL + "/v1/logs")
+	var file bytes.Buffer
+	logger := slog.New(teeHandler{
+		slog.NewJSONHandler(&file, nil),
+		&otlpHandler{exporter: exporter, level: slog.LevelInfo},
+	}).With(slog.String("boot_id", "b1"))
+
+	logger.Debug("below the level")
+	logger.WithGroup("req").Warn("slow request", slog.Int("status", 504), slog.Bool("retried", true))
+	exporter.Close()
+
+	records := received()
+	if len(records) != 1 {
+		t.Fatalf("collector got %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if *rec.Body.StringValue != "slow request" || rec.SeverityNumber != 13 || rec.SeverityText != "WARN" {
+		t.Errorf("record = %+v", rec)
+	}
+	if v, ok := attrValue(rec.Attributes, "boot_id"); !ok || *v.StringValue != "b1" {
+		t.Errorf("boot_id attribute = %+v", rec.Attributes)
+	}
+	// int64 は文字列、グループは "req.status" のように平らにする
+	if v, ok := attrValue(rec.Attributes, "req.status"); !ok || v.IntValue == nil || *v.IntValue != "504" {
+		t.Errorf("req.status attribute = %+v", rec.Attributes)
+	}
+	if v, ok := attrValue(rec.Attributes, "req.retried"); !ok || v.BoolValue == nil || !*v.BoolValue {
+		t.Errorf("req.retried attribute = %+v", rec.Attributes)
+	}
+	if !bytes.Contains(file.Bytes(), []byte(`"msg":"slow request"`)) {
+		t.Errorf("file handler got %s", file.String())
+	}
+
+	// Close の後に来たログは捨てる
+	exporter.enqueue(otlpLogRecord{})
+	exporter.Close()
+}
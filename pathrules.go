@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathRules の各値。上から順に見て最初に一致したものの action に従う
+type PathRule struct {
+	PathPattern string   `json:"pathPattern"` // * は / を含まない任意の文字列、** は / を含む任意の文字列
+	Methods     []string `json:"methods"`     // 空の場合はすべてのメソッド
+	Action      string   `json:"action"`      // allow / deny
+}
+
+type compiledPathRule struct {
+	PathRule
+	pattern *regexp.Regexp
+}
+
+func compilePathRules(rules []PathRule) ([]compiledPathRule, error) {
+	var compiled []compiledPathRule
+	for _, rule := range rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return nil, fmt.Errorf("unknown pathRules action %q", rule.Action)
+		}
+		pattern, err := regexp.Compile(globToRegexp(rule.PathPattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pathPattern %q: %w", rule.PathPattern, err)
+		}
+		compiled = append(compiled, compiledPathRule{PathRule: rule, pattern: pattern})
+	}
+	return compiled, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// "//admin" や "/x/../admin" で pathRules をすり抜けられないよう、判定の前に正規化する
+// バックエンドにも判定したのと同じパスを送る。末尾の / は残す
+// 変わらなければ RawPath もそのままにして、%2F のようにエンコードされた / を本物の / にしない
+func cleanRequestPath(r *http.Request) {
+	cleaned := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != r.URL.Path {
+		r.URL.Path = cleaned
+		r.URL.RawPath = ""
+	}
+}
+
+// 許可されていなければ 403 (deny に一致) か 404 (どれにも一致しない) を返す
+// pathRules が空なら常に 0
+func pathRuleStatus(r *http.Request, rules []compiledPathRule) int {
+	if len(rules) == 0 {
+		return 0
+	}
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(r.URL.Path) || !ruleMethodMatches(rule.Methods, r.Method) {
+			continue
+		}
+		if rule.Action == "deny" {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	return http.StatusNotFound
+}
+
+func ruleMethodMatches(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
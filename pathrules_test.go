@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathRules(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "pathRules": [
+		{"pathPattern": "/public/secret.txt", "action": "deny"},
+		{"pathPattern": "/public/**", "action": "allow"},
+		{"pathPattern": "/api/*", "methods": ["GET"], "action": "allow"}
+	]}}}`)
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		backendPath  string
+	}{
+		{"GET", "/public/css/site.css", http.StatusOK, "/public/css/site.css"},
+		{"GET", "/public/secret.txt", http.StatusForbidden, ""},
+		{"GET", "/api/users", http.StatusOK, "/api/users"},
+		{"POST", "/api/users", http.StatusNotFound, ""},
+		// * は / をまたがない
+		{"GET", "/api/users/1", http.StatusNotFound, ""},
+		{"GET", "/admin", http.StatusNotFound, ""},
+		// 正規化してから判定し、バックエンドにも正規化したパスを送る
+		{"GET", "/public/../admin", http.StatusNotFound, ""},
+		{"GET", "//public//./a/", http.StatusOK, "/public/a/"},
+		// エンコードされた / はそのまま送る。たどると別のパスになるなら正規化した形で判定する
+		{"GET", "/public/a%2Fb", http.StatusOK, "/public/a%2Fb"},
+		{"GET", "/public%2F..%2Fadmin", http.StatusNotFound, ""},
+	} {
+		gotPath = ""
+		rec := serveProxy(appRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status || gotPath != tt.backendPath {
+			t.Errorf("%s %s: got %d, backend path %q", tt.method, tt.path, rec.Code, gotPath)
+		}
+	}
+}
+
+func TestPathRulesRejectUnknownAction(t *testing.T) {
+	err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "pathRules": [{"pathPattern": "/**", "action": "block"}]}}}`))
+	if err == nil {
+		t.Error("unknown action was accepted")
+	}
+}
+
+func TestRequirePathPrefix(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "requirePathPrefix": "/api/"}}}`)
+
+	for path, status := range map[string]int{
+		"/api/users":    http.StatusOK,
+		"/admin":        http.StatusNotFound,
+		"/api":          http.StatusNotFound,
+		"/api/../admin": http.StatusNotFound,
+	} {
+		r := appRequest("GET", "/", nil)
+		r.URL.Path = path
+		if rec := serveProxy(r); rec.Code != status {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, status)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// 接続元 IP ごとの処理中のリクエスト数
+type ipLimiter struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+var perIPLimiter = &ipLimiter{inFlight: map[string]int{}}
+
+// maxRequestsPerIP を超える場合は false を返す。true のときは終わったら release を呼ぶ
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[ip] >= config.MaxRequestsPerIP {
+		return false
+	}
+	l.inFlight[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[ip]--; l.inFlight[ip] <= 0 {
+		delete(l.inFlight, ip)
+	}
+}
+
+// 接続を断るのではなく 429 を返して、クライアントに制限されたことが分かるようにする
+func writeRateLimited(w http.ResponseWriter) {
+	if config.RateLimitRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(config.RateLimitRetryAfter))
+	}
+	body := config.RateLimitBody
+	if body == "" {
+		body = "Too Many Requests"
+	}
+	http.Error(w, body, http.StatusTooManyRequests)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
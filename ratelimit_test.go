@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxRequestsPerIP(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+	defer backend.Close()
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"maxRequestsPerIP": 1, "rateLimitBody": "slow down", "rateLimitRetryAfter": 5
+	}`)
+
+	done := make(chan struct{})
+	go func() {
+		serveProxy(appRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-started
+
+	rec := serveProxy(appRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "5" || strings.TrimSpace(rec.Body.String()) != "slow down" {
+		t.Errorf("over the limit: got %d %q Retry-After %q", rec.Code, rec.Body.String(), rec.Header().Get("Retry-After"))
+	}
+	// 別の IP は制限されない
+	other := appRequest("GET", "/", nil)
+	other.RemoteAddr = "198.51.100.7:4000"
+	if rec := serveProxy(other); rec.Code != http.StatusOK {
+		t.Errorf("another IP: got %d", rec.Code)
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request did not finish")
+	}
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK {
+		t.Errorf("after the slow request finished: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 展開後の本文の上限。gzip 爆弾でメモリを使い切らないようにする
+const maxDecompressedBodyBytes = 10 << 20
+
+var errDecompressedBodyTooLarge = errors.New("decompressed request body too large")
+
+// Content-Encoding: gzip の本文を展開し、Content-Length を付け直す
+// gzip 以外の Content-Encoding はそのまま転送する
+func decompressRequestBody(r *http.Request) error {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(zr, maxDecompressedBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDecompressedBodyBytes {
+		return errDecompressedBodyTooLarge
+	}
+	r.Body.Close()
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Content-Encoding")
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressRequestBody(t *testing.T) {
+	var gotBody, gotEncoding string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotBody, gotEncoding = string(body), r.Header.Get("Content-Encoding")
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "decompressRequestBody": true}}}`)
+
+	r := appRequest("POST", "/", bytes.NewReader(gzipped(t, `{"a": 1}`)))
+	r.Header.Set("Content-Encoding", "gzip")
+	if rec := serveProxy(r); rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if gotBody != `{"a": 1}` || gotEncoding != "" {
+		t.Errorf("backend got %q with Content-Encoding %q", gotBody, gotEncoding)
+	}
+
+	r = appRequest("POST", "/", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if rec := serveProxy(r); rec.Code != http.StatusBadRequest {
+		t.Errorf("broken gzip: got %d, want 400", rec.Code)
+	}
+
+	r = appRequest("POST", "/", bytes.NewReader(gzipped(t, strings.Repeat("0", maxDecompressedBodyBytes+1))))
+	r.Header.Set("Content-Encoding", "gzip")
+	if rec := serveProxy(r); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("gzip bomb: got %d, want 413", rec.Code)
+	}
+}
+
+func TestRequestBodyTemplate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "requestBodyTemplate": "{\"data\": {{json .Body}}}", "requestBodyMaxBytes": 32}}}`)
+
+	for _, tt := range []struct {
+		name, contentType, body, want string
+	}{
+		{"json", "application/json; charset=utf-8", `{"id": 12345678901234567890}`, `{"data": {"id":12345678901234567890}}`},
+		{"not json", "text/plain", `{"id": 1}`, `{"id": 1}`},
+		{"invalid json", "application/json", `{"id": `, `{"id": `},
+		{"too large", "application/json", `{"text": "` + strings.Repeat("a", 40) + `"}`, `{"text": "` + strings.Repeat("a", 40) + `"}`},
+	} {
+		r := appRequest("POST", "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		if got := serveProxy(r).Body.String(); got != tt.want {
+			t.Errorf("%s: backend got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "requestBodyTemplate": "{{json .Body"}}}`)); err == nil {
+		t.Error("broken template was accepted")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const maxRequestIDLength = 200
+
+func requestIDHeader() string {
+	if config.RequestIDHeader != "" {
+		return config.RequestIDHeader
+	}
+	return "X-Request-ID"
+}
+
+// 受け取った相関 ID をそのまま使い、なければ生成してバックエンドに渡す
+func requestID(r *http.Request) string {
+	header := requestIDHeader()
+	id := r.Header.Get(header)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = uuid.New().String()
+		r.Header.Set(header, id)
+	}
+	return id
+}
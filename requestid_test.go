@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDHeader(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Correlation-ID")
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "requestIdHeader": "X-Correlation-ID"}`)
+
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("X-Correlation-ID", "abc-123")
+	serveProxy(r)
+	if got != "abc-123" || lastAccessLog(t)["request_id"] != "abc-123" {
+		t.Errorf("backend got %q, log %v", got, lastAccessLog(t)["request_id"])
+	}
+
+	// ないときや長すぎるときは作り直す
+	for _, id := range []string{"", strings.Repeat("x", maxRequestIDLength+1)} {
+		r := appRequest("GET", "/", nil)
+		r.Header.Set("X-Correlation-ID", id)
+		serveProxy(r)
+		if got == "" || got == id || lastAccessLog(t)["request_id"] != got {
+			t.Errorf("incoming %q: backend got %q, log %v", id, got, lastAccessLog(t)["request_id"])
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// バックエンドのエラーを種類ごとに分類してログに残す
+func upstreamErrorKind(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return "connect_timeout"
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return "tls_handshake_timeout"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case strings.Contains(err.Error(), "malformed HTTP"):
+		return "malformed"
+	case errors.Is(err, errNotHTTP2):
+		return "protocol"
+	case strings.Contains(err.Error(), "tls: no renegotiation"):
+		// tlsRenegotiation が never のバックエンドが再ネゴシエーションを求めた
+		return "tls_renegotiation"
+	}
+	return "other"
+}
+
+// バックエンドに接続できない・応答がないときの種類。インスタンスの不調とみなす
+func isTransportFailure(kind string) bool {
+	switch kind {
+	case "connect_timeout", "tls_handshake_timeout", "timeout", "reset", "refused", "eof":
+		return true
+	}
+	return false
+}
+
+// 応答を返さずに接続を切られた冪等なリクエストを 1 度だけ送り直す
+type retryTransport struct {
+	http.RoundTripper
+}
+
+func (t retryTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil || !isIdempotent(req) || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+	if kind := upstreamErrorKind(err); kind == "eof" || kind == "reset" {
+		log.Printf("Retrying %s %s after empty upstream response (%s): %v", req.Method, req.URL, kind, err)
+		return t.RoundTripper.RoundTrip(req)
+	}
+	return resp, err
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// 最初のリクエストだけ、何も返さずに接続を切るバックエンド
+func dropFirstBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	var requests atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestRetryOnEmptyResponse(t *testing.T) {
+	backend := dropFirstBackend(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "retryOnEmptyResponse": true}}}`)
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEmptyResponseWithoutRetry(t *testing.T) {
+	backend := dropFirstBackend(t)
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", rec.Code)
+	}
+	if errors := logsWithMessage(t, "upstream error"); len(errors) != 1 || errors[0]["error_kind"] != "eof" {
+		t.Errorf("upstream error logs = %v", errors)
+	}
+}
+
+func TestUpstreamErrorKind(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, "connect_timeout"},
+		{errors.New("net/http: TLS handshake timeout"), "tls_handshake_timeout"},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{context.Canceled, "canceled"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), "eof"},
+		{fmt.Errorf("%w: got HTTP/1.1 from backend.test", errNotHTTP2), "protocol"},
+		{errors.New("local error: tls: no renegotiation"), "tls_renegotiation"},
+		{errors.New("something else"), "other"},
+	} {
+		if got := upstreamErrorKind(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reusePort is not supported on this platform")
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "testing"
+
+func TestListenReusePort(t *testing.T) {
+	useConfig(t, `{"reusePort": true}`)
+	first, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// 2 つ目のプロセスの代わりに、同じポートでもう一度 listen する
+	second, err := listen(first.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", first.Addr(), err)
+	}
+	second.Close()
+
+	useConfig(t, `{}`)
+	if ln, err := listen(first.Addr().String()); err == nil {
+		ln.Close()
+		t.Error("listened on a used port without reusePort")
+	}
+}
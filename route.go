@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// これより大きな本文のリクエストはセカンダリに送り直さない
+const maxFailoverBodyBytes = 1 << 20
+
+// Retry-After が極端に長くてもプライマリを外し続けないようにする上限
+const maxRetryAfter = 10 * time.Minute
+
+var errPrimaryFailed = errors.New("primary backend returned server error")
+
+// backends のキー 1 つ分の振り分け先
+type route struct {
+	backend     Backend
+	instances   []Instance
+	proxies     []*httputil.ReverseProxy // instances ごと。instances がなければ url の 1 つだけ
+	ring        *hashRing
+	schedule    []int // roundRobin で回す instances の順番。重みの分だけ同じものが入る
+	pathRules   []compiledPathRule
+	bodyTmpl    *template.Template
+	authSchemes map[string]*httputil.ReverseProxy // Authorization のスキーム (小文字) ごとの振り分け先
+	next        atomic.Uint64
+	secondary   *httputil.ReverseProxy
+	maintenance atomic.Bool
+	allDown     http.Handler      // すべてのインスタンスが外れているときに使う。nil なら外れたものにも送る
+	coalescer   *coalescer        // coalesceRequests のときだけ
+	idempotency *idempotencyCache // idempotencyKeyTTL のときだけ
+	webSockets  atomic.Int64      // 開いている WebSocket の数
+
+	// /_/dashboard に出す直近のリクエスト数と 5xx の数
+	requests rateWindow
+	errors   rateWindow
+
+	// instances ごとに最後に接続に失敗した時刻 (UnixNano)。0 は正常
+	failedAt []atomic.Int64
+
+	// プライマリが Retry-After 付きの 503 を返したとき、この時刻 (UnixNano) までセカンダリだけを使う
+	skipPrimaryUntil atomic.Int64
+}
+
+type failoverKey struct{}
+
+// セカンダリに送り直すための元リクエストと本文
+type failover struct {
+	request *http.Request
+	body    []byte
+}
+
+func newRoute(backend Backend, cfg *Config) (*route, error) {
+	if err := backend.validate(); err != nil {
+		return nil, err
+	}
+	rt := &route{backend: backend}
+	if backend.CoalesceRequests {
+		rt.coalescer = &coalescer{apiKeyHeader: backend.APIKeyHeader, calls: map[string]*coalescedCall{}}
+	}
+	if backend.IdempotencyKeyTTL > 0 {
+		rt.idempotency = newIdempotencyCache(backend)
+	}
+	var err error
+	if rt.pathRules, err = compilePathRules(backend.PathRules); err != nil {
+		return nil, err
+	}
+	if rt.bodyTmpl, err = parseRequestBodyTemplate(backend.RequestBodyTemplate); err != nil {
+		return nil, err
+	}
+	rt.maintenance.Store(backend.Maintenance)
+	instances := backend.Instances
+	if len(instances) == 0 {
+		instances = []Instance{{URL: backend.URL}}
+	}
+	for _, instance := range instances {
+		proxy, err := newProxy(backend, cfg, instance.URL)
+		if err != nil {
+			return nil, err
+		}
+		rt.proxies = append(rt.proxies, proxy)
+	}
+	rt.instances = instances
+	rt.failedAt = make([]atomic.Int64, len(instances))
+	if backend.LoadBalancing == "consistentHash" {
+		rt.ring = newHashRing(instances)
+	} else {
+		rt.schedule = weightedSchedule(instances)
+	}
+	if backend.SecondaryBackend != "" {
+		rt.secondary, err = newProxy(backend, cfg, backend.SecondaryBackend)
+		if err != nil {
+			return nil, err
+		}
+		for _, proxy := range rt.proxies {
+			rt.enableFailover(proxy)
+		}
+	}
+	for scheme, target := range backend.AuthSchemeBackends {
+		proxy, err := newProxy(backend, cfg, target)
+		if err != nil {
+			return nil, err
+		}
+		if rt.authSchemes == nil {
+			rt.authSchemes = map[string]*httputil.ReverseProxy{}
+		}
+		rt.authSchemes[strings.ToLower(scheme)] = proxy
+	}
+	for i, proxy := range rt.proxies {
+		rt.trackHealth(i, proxy)
+	}
+	if err := rt.setAllDown(cfg); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// プライマリのタイムアウトや 5xx をセカンダリで処理するようにする
+func (rt *route) enableFailover(proxy *httputil.ReverseProxy) {
+	backend := rt.backend
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(response *http.Response) error {
+		if response.StatusCode == http.StatusServiceUnavailable {
+			if d, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+				log.Printf("Primary backend %s asked to retry after %s, using %s until then", response.Request.URL.Host, d, backend.SecondaryBackend)
+				rt.skipPrimaryUntil.Store(time.Now().Add(d).UnixNano())
+			}
+		}
+		_, ok := response.Request.Context().Value(failoverKey{}).(*failover)
+		if ok && response.StatusCode >= http.StatusInternalServerError {
+			return errPrimaryFailed
+		}
+		return modifyResponse(response)
+	}
+	proxy.ErrorHandler = rt.failover
+}
+
+// このルートのバックエンドへの idle な接続をすべて閉じる。次のリクエストから接続し直す
+func (rt *route) closeIdleConnections() {
+	proxies := rt.proxies
+	if rt.secondary != nil {
+		proxies = append(proxies[:len(proxies):len(proxies)], rt.secondary)
+	}
+	for _, proxy := range proxies {
+		if c, ok := proxy.Transport.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// loadBalancing: roundRobin (既定) / consistentHash
+// instanceCooldown 中のインスタンスは避け、すべて外れていれば allDown か emptyPoolPolicy に従う
+func (rt *route) pick(r *http.Request) http.Handler {
+	if i := rt.pickInstance(r, rt.healthy); i >= 0 {
+		return rt.proxies[i]
+	}
+	if rt.allDown != nil {
+		return rt.allDown
+	}
+	switch rt.backend.EmptyPoolPolicy {
+	case "fail":
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		})
+	case "tryLastResort":
+		return rt.proxies[rt.leastRecentlyFailed()]
+	}
+	return rt.proxies[rt.pickInstance(r, anyInstance)]
+}
+
+func (rt *route) pickInstance(r *http.Request, usable func(int) bool) int {
+	if rt.ring != nil {
+		return rt.ring.get(consistentHashKey(r, rt.backend.HashKey), usable)
+	}
+	n := uint64(len(rt.schedule))
+	start := uint64(0)
+	if n > 1 {
+		start = rt.next.Add(1) - 1
+	}
+	for k := uint64(0); k < n; k++ {
+		if i := rt.schedule[(start+k)%n]; usable(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rt.maintenance.Load() {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(maintenancePage()))
+		return
+	}
+	if len(rt.pathRules) > 0 || rt.backend.RequirePathPrefix != "" {
+		cleanRequestPath(r)
+	}
+	if !strings.HasPrefix(r.URL.Path, rt.backend.RequirePathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if rt.backend.APIKeyHeader != "" && !validAPIKey(r, rt.backend) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if status := pathRuleStatus(r, rt.pathRules); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !allowedContentType(r, rt.backend.AllowedContentTypes) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !injectLatency(r, rt.backend.InjectLatency) {
+		return
+	}
+	if injectError(w, r, rt.backend.InjectError) {
+		return
+	}
+	if rt.backend.DecompressRequestBody {
+		if err := decompressRequestBody(r); errors.Is(err, errDecompressedBodyTooLarge) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			log.Printf("Rejected request from %s: cannot decompress body: %v", r.RemoteAddr, err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if rt.bodyTmpl != nil {
+		if err := transformRequestBody(r, rt.bodyTmpl, rt.backend.RequestBodyMaxBytes); err != nil {
+			log.Printf("Failed to transform request body from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(rt.backend.FlushStatuses) > 0 {
+		w = &flushByStatusWriter{ResponseWriter: w, statuses: rt.backend.FlushStatuses}
+	}
+	if rt.backend.MirrorTo != "" {
+		defer startMirror(r, rt.backend)()
+	}
+	if rt.backend.MaxWebSocketConns > 0 && isWebSocketUpgrade(r) {
+		if !rt.acquireWebSocket(w, r) {
+			return
+		}
+		defer rt.releaseWebSocket()
+	}
+	if rt.coalescer != nil && coalescable(r) {
+		rt.coalescer.serve(w, r, rt.forward)
+		return
+	}
+	if rt.idempotency != nil {
+		rt.idempotency.serve(w, r, rt.forward)
+		return
+	}
+	rt.forward(w, r)
+}
+
+// 認証スキームやフェイルオーバーの設定に従ってバックエンドに送る
+func (rt *route) forward(w http.ResponseWriter, r *http.Request) {
+	if proxy, ok := rt.authSchemes[authScheme(r)]; ok {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if rt.secondary == nil {
+		rt.pick(r).ServeHTTP(w, r)
+		return
+	}
+	if time.Now().UnixNano() < rt.skipPrimaryUntil.Load() {
+		rt.secondary.ServeHTTP(w, r)
+		return
+	}
+
+	// セカンダリに送り直せるよう本文を読み込んでおく
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFailoverBodyBytes+1))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxFailoverBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		rt.pick(r).ServeHTTP(w, r)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	ctx := context.WithValue(r.Context(), failoverKey{}, &failover{request: r, body: body})
+	rt.pick(r).ServeHTTP(w, r.WithContext(ctx))
+}
+
+// プライマリがタイムアウトや 5xx を返したときにセカンダリで処理する
+func (rt *route) failover(w http.ResponseWriter, req *http.Request, err error) {
+	state, ok := req.Context().Value(failoverKey{}).(*failover)
+	if !ok {
+		proxyErrorHandler(w, req, err)
+		return
+	}
+	log.Printf("Primary backend %s failed, falling back to %s: %v", req.URL.Host, rt.backend.SecondaryBackend, err)
+	retry := state.request.Clone(req.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(state.body))
+	rt.secondary.ServeHTTP(w, retry)
+}
+
+// Retry-After の秒数または HTTP-date を待ち時間に変換する
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		d = time.Until(at)
+	} else {
+		return 0, false
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	return min(d, maxRetryAfter), true
+}
+
+func maintenancePage() string {
+	if config.MaintenancePage != "" {
+		return config.MaintenancePage
+	}
+	return "<!doctype html><title>Maintenance</title><h1>Under maintenance</h1><p>Please try again later.</p>"
+}
+
+// Authorization ヘッダーのスキームを小文字で返す。ヘッダーがなければ "none"
+// 振り分けはプロキシの中だけで決め、バックエンドには選んだ結果を伝えない
+func authScheme(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "none"
+	}
+	scheme, _, _ := strings.Cut(authorization, " ")
+	return strings.ToLower(scheme)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func textBackend(t *testing.T, text string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(text))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestSecondaryBackendOnTimeoutAndServerError(t *testing.T) {
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("secondary " + string(body)))
+	}))
+	defer secondary.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	for _, primary := range []*httptest.Server{slow, broken} {
+		useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "responseTimeout": 100, "secondaryBackend": %q}}}`, primary.URL, secondary.URL))
+		rec := serveProxy(appRequest("POST", "/", strings.NewReader("body")))
+		// セカンダリにも同じ本文が届く
+		if rec.Code != http.StatusOK || rec.Body.String() != "secondary body" {
+			t.Errorf("got %d %q", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRetryAfterSkipsPrimary(t *testing.T) {
+	var primaryHits atomic.Int64
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := textBackend(t, "secondary")
+	useConfig(t, fmt.Sprintf(`{"backends": {"app.test": {"url": %q, "secondaryBackend": %q}}}`, primary.URL, secondary.URL))
+
+	for i := 0; i < 3; i++ {
+		if rec := serveProxy(appRequest("GET", "/", nil)); rec.Body.String() != "secondary" {
+			t.Fatalf("request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if got := primaryHits.Load(); got != 1 {
+		t.Errorf("primary was hit %d times during Retry-After, want 1", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{"86400", maxRetryAfter, true},
+		{"0", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := parseRetryAfter(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s %t, want %s %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+	if d, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); !ok || d < 9*time.Minute {
+		t.Errorf("HTTP-date: got %s %t", d, ok)
+	}
+}
+
+func TestAuthSchemeBackends(t *testing.T) {
+	defaultBackend, bearer, anonymous := textBackend(t, "default"), textBackend(t, "bearer"), textBackend(t, "anonymous")
+	useConfig(t, `{"backends": {"app.test": {"url": "`+defaultBackend.URL+`", "authSchemeBackends": {"Bearer": "`+bearer.URL+`", "none": "`+anonymous.URL+`"}}}}`)
+
+	for authorization, want := range map[string]string{
+		"Bearer abc":   "bearer",
+		"bearer abc":   "bearer",
+		"":             "anonymous",
+		"Basic dXNlcg": "default",
+	} {
+		r := appRequest("GET", "/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if got := serveProxy(r).Body.String(); got != want {
+			t.Errorf("Authorization %q: routed to %q, want %q", authorization, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type routeByKey struct{}
+
+// リスナーごとのルーティング方式をリクエストのコンテキストに載せる
+func withRouteBy(handler http.Handler, routeBy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), routeByKey{}, routeBy)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Host が接続を受けたアドレスの IP そのものなら true
+func isOwnIPHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	return ip.Equal(net.ParseIP(localHost))
+}
+
+// ルーティングに使うホスト名を返す
+// sni モードでは TLS の SNI を使い、平文のリクエストは Host にフォールバックする
+// SNI なしの TLS 接続は振り分け先を決められないので false を返す
+func routingHost(r *http.Request) (string, bool) {
+	routeBy, _ := r.Context().Value(routeByKey{}).(string)
+	if routeBy != "sni" || r.TLS == nil {
+		return r.Host, true
+	}
+	if r.TLS.ServerName == "" {
+		return "", false
+	}
+	return r.TLS.ServerName, true
+}
+
+// 今のところホスト名の前方一致だけ。アクセスログの match_mode に出す
+const routeMatchMode = "prefix"
+
+func matchRoute(host string) (string, bool) {
+	for key := range routes {
+		if strings.HasPrefix(host, key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// あるキーが別のキーの前方一致にもなっていると、どちらに振り分けられるかが決まらない
+// "a.example.com" と "a.example.com.cn" のような組を返す
+func overlappingRoutes(backends map[string]Backend) [][2]string {
+	keys := make([]string, 0, len(backends))
+	for key := range backends {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var overlaps [][2]string
+	for i, a := range keys {
+		for _, b := range keys[i+1:] {
+			if strings.HasPrefix(b, a) {
+				overlaps = append(overlaps, [2]string{a, b})
+			}
+		}
+	}
+	return overlaps
+}
+
+// onOverlappingRoutes: ignore (既定) / warn / error
+func checkOverlappingRoutes(c Config) error {
+	switch c.OnOverlappingRoutes {
+	case "", "ignore":
+		return nil
+	case "warn", "error":
+	default:
+		return fmt.Errorf("unknown onOverlappingRoutes %q", c.OnOverlappingRoutes)
+	}
+	overlaps := overlappingRoutes(c.Backends)
+	if len(overlaps) == 0 {
+		return nil
+	}
+	if c.OnOverlappingRoutes == "error" {
+		return fmt.Errorf("overlapping backends %q and %q", overlaps[0][0], overlaps[0][1])
+	}
+	for _, o := range overlaps {
+		log.Printf("Backends %q and %q overlap: hosts starting with %q match both", o[0], o[1], o[1])
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutingHostBySNI(t *testing.T) {
+	withRouteByMode := func(r *http.Request, routeBy string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), routeByKey{}, routeBy))
+	}
+
+	tests := []struct {
+		name    string
+		routeBy string
+		tls     *tls.ConnectionState
+		want    string
+		ok      bool
+	}{
+		{"host mode ignores SNI", "host", &tls.ConnectionState{ServerName: "sni.test"}, "host.test", true},
+		{"sni mode uses SNI", "sni", &tls.ConnectionState{ServerName: "sni.test"}, "sni.test", true},
+		{"sni mode falls back to Host over plain HTTP", "sni", nil, "host.test", true},
+		{"sni mode without SNI", "sni", &tls.ConnectionState{}, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "host.test"
+		r.TLS = tt.tls
+		got, ok := routingHost(withRouteByMode(r, tt.routeBy))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %q %t, want %q %t", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSNIWithoutServerNameIsMisdirected(t *testing.T) {
+	useConfig(t, `{"backends": {"app.test": "http://127.0.0.1:1"}}`)
+	r := appRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	rec := httptest.NewRecorder()
+	withRouteBy(http.HandlerFunc(handleProxy), "sni").ServeHTTP(rec, r)
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("got %d, want 421", rec.Code)
+	}
+}
+
+func TestAccessLogMatchedRoute(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.": "`+backend.URL+`"}}`)
+	r := appRequest("GET", "/", nil)
+	r.Host = "app.example.com"
+	serveProxy(r)
+	entry := lastAccessLog(t)
+	if entry["match_mode"] != "prefix" || entry["match_pattern"] != "app." || entry["host"] != "app.example.com" {
+		t.Errorf("access log = %v", entry)
+	}
+}
+
+func TestOnOverlappingRoutes(t *testing.T) {
+	overlapping := `"backends": {"a.example.com": "http://127.0.0.1:1", "a.example.com.cn": "http://127.0.0.1:1", "b.example.com": "http://127.0.0.1:1"}`
+
+	useConfig(t, `{`+overlapping+`}`)
+	// 警告は useConfig が消してしまうので、もう一度読み込んで確かめる
+	testLog.Reset()
+	if err := applyConfigJson([]byte(`{` + overlapping + `, "onOverlappingRoutes": "warn"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(testLog.String(), `Backends \"a.example.com\" and \"a.example.com.cn\" overlap`) {
+		t.Errorf("no overlap warning in %s", testLog.String())
+	}
+
+	err := applyConfigJson([]byte(`{` + overlapping + `, "onOverlappingRoutes": "error"}`))
+	if err == nil || !strings.Contains(err.Error(), `"a.example.com" and "a.example.com.cn"`) {
+		t.Errorf("onOverlappingRoutes error: err = %v", err)
+	}
+	if err := applyConfigJson([]byte(`{"onOverlappingRoutes": "panic"}`)); err == nil {
+		t.Error("unknown onOverlappingRoutes was accepted")
+	}
+}
+
+func TestIPHostHealthProbe(t *testing.T) {
+	backend := textBackend(t, "backend")
+	get := func(proxy *httptest.Server, host string) string {
+		req, _ := http.NewRequest("GET", proxy.URL+"/", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	useConfig(t, `{"backends": {"127.0.0.1": "`+backend.URL+`", "10.9.9.9": "`+backend.URL+`"}, "ipHostHealthProbe": true}`)
+	proxy := newProxyServer(t)
+	ownHost := proxy.Listener.Addr().String()
+	for host, want := range map[string]string{
+		ownHost:     "ok",
+		"127.0.0.1": "ok",
+		// 自分以外の IP はふつうに振り分ける
+		"10.9.9.9": "backend",
+	} {
+		if got := get(proxy, host); got != want {
+			t.Errorf("Host %s: got %q, want %q", host, got, want)
+		}
+	}
+
+	useConfig(t, `{"backends": {"127.0.0.1": "`+backend.URL+`"}}`)
+	if got := get(proxy, "127.0.0.1"); got != "backend" {
+		t.Errorf("without ipHostHealthProbe: got %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// 起動直後に自分自身へ TLS で接続し、backends のキーごとに 1 回ずつリクエストを送る
+// 証明書は自己署名のこともあるので検証せず、ハンドシェイクできるかとルーティングだけを見る
+// Let's Encrypt を使うときは、SNI を送るだけで証明書の取得が始まってしまうので、
+// certCache にまだ証明書がないキーは飛ばす
+func runSelfTest(certCache autocert.Cache) {
+	keys := make([]string, 0, len(routes))
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	failed, skipped := 0, 0
+	for _, key := range keys {
+		if certCache != nil && !hasCachedCert(certCache, key) {
+			skipped++
+			log.Printf("Self-test skipped for %s: no cached certificate yet", key)
+			continue
+		}
+		if err := selfTestRoute(key); err != nil {
+			failed++
+			log.Printf("Self-test failed for %s: %v", key, err)
+			continue
+		}
+		log.Printf("Self-test passed for %s", key)
+	}
+	log.Printf("Self-test finished: %d passed, %d failed, %d skipped", len(keys)-failed-skipped, failed, skipped)
+	if failed > 0 && config.SelfTestExitOnFailure {
+		log.Fatal("Exiting because the self-test failed")
+	}
+}
+
+// autocert は ECDSA の証明書をドメイン名、RSA の証明書を "ドメイン名+rsa" で保存する
+func hasCachedCert(certCache autocert.Cache, domain string) bool {
+	for _, name := range []string{domain, domain + "+rsa"} {
+		if _, err := certCache.Get(context.Background(), name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func selfTestRoute(key string) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: key, InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://127.0.0.1:%d/", config.Port), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = key
+	req.Header.Set("User-Agent", "tiny_proxy-selftest")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestHasCachedCert(t *testing.T) {
+	certCache := autocert.DirCache(t.TempDir())
+	if hasCachedCert(certCache, "app.test") {
+		t.Fatal("empty cache has a certificate")
+	}
+	certCache.Put(context.Background(), "app.test+rsa", []byte("cert"))
+	if !hasCachedCert(certCache, "app.test") {
+		t.Error("RSA certificate was not found")
+	}
+	certCache.Put(context.Background(), "other.test", []byte("cert"))
+	if !hasCachedCert(certCache, "other.test") {
+		t.Error("ECDSA certificate was not found")
+	}
+}
+
+// 自分自身の代わりに TLS のテストサーバーへ送らせる
+func useSelfTestServer(t *testing.T) {
+	t.Helper()
+	u, _ := url.Parse(newTLSProxyServer(t).URL)
+	config.Port, _ = strconv.Atoi(u.Port())
+}
+
+func TestSelfTestRoute(t *testing.T) {
+	ok := textBackend(t, "ok")
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	useConfig(t, `{"backends": {"app.test": "`+ok.URL+`", "broken.test": "`+broken.URL+`"}}`)
+	useSelfTestServer(t)
+
+	if err := selfTestRoute("app.test"); err != nil {
+		t.Errorf("healthy route failed: %v", err)
+	}
+	if err := selfTestRoute("broken.test"); err == nil {
+		t.Error("route answering 500 passed")
+	}
+}
+
+func TestRunSelfTestSkipsUncachedCerts(t *testing.T) {
+	ok := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+ok.URL+`", "new.test": "`+ok.URL+`"}}`)
+	useSelfTestServer(t)
+	certCache := autocert.DirCache(t.TempDir())
+	certCache.Put(context.Background(), "app.test", []byte("cert"))
+
+	runSelfTest(certCache)
+	if len(logsWithMessage(t, "Self-test finished: 1 passed, 0 failed, 1 skipped")) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// シャットダウン待ちの間は true になり、readiness が 503 を返す
+var draining atomic.Bool
+
+// 起動した時刻。readinessDelay の経過を数える
+var startedAt = time.Now()
+
+// readiness: 起動直後の readinessDelay の間とドレイン中は 503 を返してロードバランサから外してもらう
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if time.Since(startedAt) < seconds(config.ReadinessDelay) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("starting"))
+		return
+	}
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// liveness: プロセスがリクエストを処理できていれば常に 200
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// SIGTERM / SIGINT を受けたらドレインしてからサーバーを止める
+func waitForShutdown(servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+
+	draining.Store(true)
+	log.Printf("Draining for %d seconds before shutdown", config.DrainDelay)
+	time.Sleep(time.Duration(config.DrainDelay) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown failed for %s: %v", server.Addr, err)
+		}
+	}
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReportsDraining(t *testing.T) {
+	defer draining.Store(false)
+
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/_/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("before drain: got %d", rec.Code)
+	}
+
+	draining.Store(true)
+	rec = httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/_/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "draining" {
+		t.Errorf("during drain: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// liveness はドレイン中も 200
+	rec = httptest.NewRecorder()
+	handleLive(rec, httptest.NewRequest("GET", "/_/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("live during drain: got %d", rec.Code)
+	}
+}
+
+func TestHealthWaitsForReadinessDelay(t *testing.T) {
+	useConfig(t, `{"readinessDelay": 60}`)
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/_/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "starting" {
+		t.Errorf("during readinessDelay: got %d %q", rec.Code, rec.Body.String())
+	}
+
+	prev := startedAt
+	defer func() { startedAt = prev }()
+	startedAt = time.Now().Add(-time.Minute)
+	rec = httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/_/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after readinessDelay: got %d", rec.Code)
+	}
+}
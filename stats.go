@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 直近 statsWindow 秒のイベント数を 1 秒ごとのバケットで数える
+const statsWindow = 60
+
+type rateWindow struct {
+	mu      sync.Mutex
+	counts  [statsWindow]int64
+	seconds [statsWindow]int64 // バケットがどの秒のものか
+}
+
+func (w *rateWindow) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % statsWindow
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seconds[i] != sec {
+		w.seconds[i] = sec
+		w.counts[i] = 0
+	}
+	w.counts[i]++
+}
+
+// 直近 statsWindow 秒の合計
+func (w *rateWindow) sum(now time.Time) int64 {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var total int64
+	for i := range w.counts {
+		if sec-w.seconds[i] < statsWindow {
+			total += w.counts[i]
+		}
+	}
+	return total
+}
+
+// 全体のリクエスト数。ルートごとの数は route が持つ
+var allRequests rateWindow
+
+func recordRequest(rt *route, status int) {
+	now := time.Now()
+	allRequests.add(now)
+	rt.requests.add(now)
+	if status >= 500 {
+		rt.errors.add(now)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"text/template"
+)
+
+// バックエンドのステータスが from〜to のとき、クライアントには status と body を返す
+type StatusMapping struct {
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	Status      int    `json:"status"`
+	Body        string `json:"body"`        // text/template。{{.Status}} {{.RequestID}} が使える
+	ContentType string `json:"contentType"` // 既定は text/plain; charset=utf-8
+}
+
+type compiledStatusMapping struct {
+	StatusMapping
+	body *template.Template
+}
+
+func compileStatusMappings(mappings []StatusMapping) ([]compiledStatusMapping, error) {
+	var compiled []compiledStatusMapping
+	for _, m := range mappings {
+		if m.To == 0 {
+			m.To = m.From
+		}
+		if m.From < 100 || m.To > 599 || m.From > m.To || m.Status < 100 || m.Status > 599 {
+			return nil, fmt.Errorf("invalid statusMap entry %d-%d -> %d", m.From, m.To, m.Status)
+		}
+		body, err := template.New("statusMap").Parse(m.Body)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledStatusMapping{StatusMapping: m, body: body})
+	}
+	return compiled, nil
+}
+
+// 一致した最初の設定でレスポンスを差し替える。元のステータスはログにだけ残す
+func mapUpstreamStatus(response *http.Response, mappings []compiledStatusMapping) error {
+	for _, m := range mappings {
+		if response.StatusCode < m.From || response.StatusCode > m.To {
+			continue
+		}
+		requestID := response.Request.Header.Get(requestIDHeader())
+		log.Printf("Mapped upstream status %d from %s to %d (request_id %s)", response.StatusCode, response.Request.URL.Host, m.Status, requestID)
+
+		var body bytes.Buffer
+		if err := m.body.Execute(&body, map[string]any{"Status": m.Status, "RequestID": requestID}); err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+		response.Body.Close()
+
+		contentType := m.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		// バックエンドの詳細が漏れないようヘッダーも作り直す
+		response.Header = http.Header{}
+		response.Header.Set("Content-Type", contentType)
+		response.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+		response.Trailer = nil
+		response.StatusCode = m.Status
+		response.Status = fmt.Sprintf("%d %s", m.Status, http.StatusText(m.Status))
+		response.ContentLength = int64(body.Len())
+		response.Body = io.NopCloser(&body)
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusMap(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Version", "1.2.3")
+		switch r.URL.Path {
+		case "/crash":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("stack trace"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "statusMap": [
+		{"from": 500, "to": 599, "status": 502, "body": "{\"status\": {{.Status}}, \"request_id\": \"{{.RequestID}}\"}", "contentType": "application/json"}
+	]}}, "requestIdHeader": "X-Request-ID"}`)
+
+	r := appRequest("GET", "/crash", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	rec := serveProxy(r)
+	if rec.Code != http.StatusBadGateway || rec.Body.String() != `{"status": 502, "request_id": "req-1"}` {
+		t.Errorf("mapped response: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Backend-Version") != "" || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("mapped response headers = %v", rec.Header())
+	}
+	if !strings.Contains(testLog.String(), "Mapped upstream status 500") {
+		t.Errorf("log = %s", testLog.String())
+	}
+
+	// 範囲外はそのまま
+	if rec := serveProxy(appRequest("GET", "/missing", nil)); rec.Code != http.StatusNotFound || rec.Header().Get("X-Backend-Version") != "1.2.3" {
+		t.Errorf("unmapped response: got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestStatusMapValidation(t *testing.T) {
+	for _, mapping := range []string{
+		`{"from": 600, "status": 502}`,
+		`{"from": 500, "to": 400, "status": 502}`,
+		`{"from": 500, "status": 0}`,
+		`{"from": 500, "status": 502, "body": "{{.Status"}`,
+	} {
+		if err := applyConfigJson([]byte(`{"backends": {"app.test": {"url": "http://127.0.0.1:1", "statusMap": [` + mapping + `]}}}`)); err == nil {
+			t.Errorf("statusMap %s was accepted", mapping)
+		}
+	}
+}
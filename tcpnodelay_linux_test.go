@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// バックエンドへの接続に付いた TCP_NODELAY を読む
+func dialedNoDelay(t *testing.T, addr string) int {
+	t.Helper()
+	transport := routes["app.test"].proxies[0].Transport.(*http.Transport)
+	conn, err := transport.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	for backend, want := range map[string]int{
+		`{"url": "http://` + addr + `"}`:                      1,
+		`{"url": "http://` + addr + `", "tcpNoDelay": false}`: 0,
+		`{"url": "http://` + addr + `", "tcpNoDelay": true}`:  1,
+	} {
+		useConfig(t, `{"backends": {"app.test": `+backend+`}}`)
+		if got := dialedNoDelay(t, addr); got != want {
+			t.Errorf("%s: TCP_NODELAY = %d, want %d", backend, got, want)
+		}
+	}
+}
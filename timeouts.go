@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 個別に指定のないタイムアウトを defaultTimeout で埋める
+func applyDefaultTimeouts(c *Config) {
+	if c.DefaultTimeout <= 0 {
+		return
+	}
+	for _, timeout := range []*int{&c.ReadTimeout, &c.WriteTimeout, &c.IdleTimeout, &c.RequestTimeout} {
+		if *timeout == 0 {
+			*timeout = c.DefaultTimeout
+		}
+	}
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func applyServerTimeouts(server *http.Server) {
+	server.ReadTimeout = seconds(config.ReadTimeout)
+	server.WriteTimeout = seconds(config.WriteTimeout)
+	server.IdleTimeout = seconds(config.IdleTimeout)
+}
+
+type requestDeadlineKey struct{}
+
+// リクエストの打ち切りまでの時間。レスポンスがストリーミングと分かった時点で延長できる
+type requestDeadline struct {
+	w        http.ResponseWriter
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+func (d *requestDeadline) reset(timeout time.Duration) {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, func() {
+			d.timedOut.Store(true)
+			d.cancel()
+		})
+	}
+}
+
+// ストリーミングでは writeTimeout (サーバー全体の書き込み期限) で切られないよう、
+// 接続の書き込み期限も streamingTimeout (0 なら無制限) に合わせる
+func (d *requestDeadline) stream() {
+	d.reset(seconds(config.StreamingTimeout))
+	var deadline time.Time
+	if config.StreamingTimeout > 0 {
+		deadline = time.Now().Add(seconds(config.StreamingTimeout))
+	}
+	http.NewResponseController(d.w).SetWriteDeadline(deadline)
+}
+
+// requestTimeout を過ぎたらバックエンドへのリクエストを打ち切る
+// ストリーミングのルートには代わりに streamingTimeout (0 なら無制限) を使う
+func withRequestTimeout(w http.ResponseWriter, r *http.Request, streaming bool) (*http.Request, context.CancelFunc) {
+	if config.RequestTimeout <= 0 && config.StreamingTimeout <= 0 && config.WriteTimeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	d := &requestDeadline{w: w, cancel: cancel}
+	if streaming {
+		d.stream()
+	} else {
+		d.reset(seconds(config.RequestTimeout))
+	}
+	ctx = context.WithValue(ctx, requestDeadlineKey{}, d)
+	return r.WithContext(ctx), func() {
+		d.reset(0)
+		cancel()
+	}
+}
+
+// text/event-stream など長く続くレスポンスには streamingTimeout を適用し直す
+func extendForStreaming(ctx context.Context) {
+	if d, ok := ctx.Value(requestDeadlineKey{}).(*requestDeadline); ok {
+		d.stream()
+	}
+}
+
+func requestTimedOut(ctx context.Context) bool {
+	d, ok := ctx.Value(requestDeadlineKey{}).(*requestDeadline)
+	return ok && d.timedOut.Load()
+}
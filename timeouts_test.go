@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultTimeout(t *testing.T) {
+	c, err := parseConfigJson([]byte(`{"defaultTimeout": 30, "idleTimeout": 120}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ReadTimeout != 30 || c.WriteTimeout != 30 || c.RequestTimeout != 30 || c.IdleTimeout != 120 {
+		t.Errorf("timeouts = read %d write %d request %d idle %d", c.ReadTimeout, c.WriteTimeout, c.RequestTimeout, c.IdleTimeout)
+	}
+
+	useConfig(t, `{"defaultTimeout": 30, "idleTimeout": 120}`)
+	server := &http.Server{}
+	applyServerTimeouts(server)
+	if server.ReadTimeout != 30*time.Second || server.IdleTimeout != 120*time.Second {
+		t.Errorf("server timeouts = read %s idle %s", server.ReadTimeout, server.IdleTimeout)
+	}
+
+	// 読み直しで defaultTimeout を消したら、前に埋めた値も残らない
+	useConfig(t, `{}`)
+	if config.ReadTimeout != 0 || config.RequestTimeout != 0 {
+		t.Errorf("after removing defaultTimeout: read %d request %d", config.ReadTimeout, config.RequestTimeout)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "defaultTimeout": 1}`)
+
+	start := time.Now()
+	rec := serveProxy(appRequest("GET", "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+}
+
+func TestStreamingTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(400 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	useConfig(t, `{
+		"backends": {"app.test": "`+backend.URL+`"},
+		"requestTimeout": 1, "writeTimeout": 1, "streamingTimeout": 10
+	}`)
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(handleProxy))
+	applyServerTimeouts(proxy.Config)
+	proxy.Start()
+	defer proxy.Close()
+
+	// requestTimeout と writeTimeout を過ぎても、イベントストリームは最後まで届く
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "app.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream cut after %q: %v", body, err)
+	}
+	if got := strings.Count(string(body), "data: "); got != 5 {
+		t.Errorf("got %d events: %q", got, body)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// https リスナーの TLS 設定を組み立てる
+func configureTLS(tlsConfig *tls.Config) error {
+	if config.LogLevel == "debug" {
+		tlsConfig.GetConfigForClient = logClientHello
+	}
+	if len(config.AllowedALPN) > 0 {
+		tlsConfig.VerifyConnection = verifyALPN
+	}
+	return configureClientAuth(tlsConfig)
+}
+
+// allowedAlpn にないプロトコルをネゴシエートした接続はハンドシェイクを失敗させて閉じる
+// ALPN を使わないクライアントは "none" として扱う
+// 接続元は http.Server の TLS handshake error のログに出る
+func verifyALPN(cs tls.ConnectionState) error {
+	protocol := cs.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	for _, allowed := range config.AllowedALPN {
+		if protocol == allowed {
+			return nil
+		}
+	}
+	slog.Warn("rejected tls connection with disallowed alpn",
+		slog.String("server_name", cs.ServerName),
+		slog.String("alpn", protocol),
+	)
+	return fmt.Errorf("alpn %q is not allowed", protocol)
+}
+
+// clientCaPath が設定されていればクライアント証明書 (mTLS) を検証する
+func configureClientAuth(tlsConfig *tls.Config) error {
+	if config.ClientCAPath == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(config.ClientCAPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", config.ClientCAPath)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// 提示されたクライアント証明書の SHA-256 フィンガープリント
+func clientCertFingerprint(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// TLS ネゴシエーションの調査用に ClientHello の内容をデバッグログに出す
+func logClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	cipherSuites := make([]string, 0, len(hello.CipherSuites))
+	for _, id := range hello.CipherSuites {
+		cipherSuites = append(cipherSuites, tls.CipherSuiteName(id))
+	}
+	versions := make([]string, 0, len(hello.SupportedVersions))
+	for _, v := range hello.SupportedVersions {
+		versions = append(versions, tls.VersionName(v))
+	}
+	slog.Debug("tls client hello",
+		slog.String("remote_addr", hello.Conn.RemoteAddr().String()),
+		slog.String("server_name", hello.ServerName),
+		slog.Any("alpn", hello.SupportedProtos),
+		slog.Any("cipher_suites", cipherSuites),
+		slog.Any("versions", versions),
+	)
+	return nil, nil
+}
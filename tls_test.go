@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// テスト用の自己署名証明書と、その PEM (証明書、鍵)
+func selfSignedCert(t *testing.T, name string, notAfter time.Time, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+// configureTLS を通した https の handleProxy
+func newTLSProxyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleProxy))
+	server.TLS = &tls.Config{}
+	if err := configureTLS(server.TLS); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func tlsClient(tlsConfig *tls.Config) *http.Client {
+	tlsConfig.InsecureSkipVerify = true
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func TestClientCertFingerprintLogged(t *testing.T) {
+	clientCert, clientPEM, _ := selfSignedCert(t, "client.test", time.Now().Add(time.Hour), x509.ExtKeyUsageClientAuth)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caPath, clientPEM, 0644)
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "clientCaPath": "`+caPath+`", "requireClientCert": true}`)
+	proxy := newTLSProxyServer(t)
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "app.test"
+	resp, err := tlsClient(&tls.Config{Certificates: []tls.Certificate{clientCert}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sum := sha256.Sum256(clientCert.Certificate[0])
+	if got := lastAccessLog(t)["tls_client_cert_sha256"]; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("tls_client_cert_sha256 = %v", got)
+	}
+
+	// requireClientCert では証明書なしの接続を断る
+	req, _ = http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "app.test"
+	if resp, err := tlsClient(&tls.Config{}).Do(req); err == nil {
+		resp.Body.Close()
+		t.Error("request without a client certificate succeeded")
+	}
+}
+
+func TestClientHelloLoggedAtDebug(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "logLevel": "debug"}`)
+	proxy := newTLSProxyServer(t)
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "app.test"
+	resp, err := tlsClient(&tls.Config{ServerName: "app.test"}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	hellos := logsWithMessage(t, "tls client hello")
+	if len(hellos) != 1 || hellos[0]["server_name"] != "app.test" || hellos[0]["level"] != "DEBUG" {
+		t.Fatalf("client hello logs = %v", hellos)
+	}
+	if versions, _ := hellos[0]["versions"].([]any); len(versions) == 0 {
+		t.Errorf("no TLS versions logged: %v", hellos[0])
+	}
+}
+
+func TestAllowedALPN(t *testing.T) {
+	useConfig(t, `{"allowedAlpn": ["http/1.1"]}`)
+	proxy := newTLSProxyServer(t)
+
+	for _, tt := range []struct {
+		nextProtos []string
+		ok         bool
+	}{
+		{[]string{"http/1.1"}, true},
+		// ALPN を送らないクライアントは "none"
+		{nil, false},
+	} {
+		testLog.Reset()
+		conn, err := tls.Dial("tcp", proxy.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tt.nextProtos})
+		if err == nil {
+			// TLS 1.3 ではサーバー側の失敗が最初の読み込みで分かる
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1))
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = nil
+			}
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("ALPN %v: err = %v", tt.nextProtos, err)
+		}
+		if !tt.ok {
+			if rejected := logsWithMessage(t, "rejected tls connection with disallowed alpn"); len(rejected) != 1 || rejected[0]["alpn"] != "none" {
+				t.Errorf("ALPN %v: logs = %v", tt.nextProtos, rejected)
+			}
+		}
+	}
+}
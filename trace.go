@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// バックエンドへの接続状況を記録する
+type upstreamTrace struct {
+	gotConn        bool
+	connReused     bool
+	upstreamFailed bool // エラーページを返した
+	faultInjected  bool // injectError で返した
+
+	start     time.Time // プロキシがリクエストを受け取った時刻
+	getConn   time.Time
+	firstByte time.Time
+}
+
+type upstreamTraceKey struct{}
+
+func withUpstreamTrace(r *http.Request, start time.Time) (*http.Request, *upstreamTrace) {
+	ut := &upstreamTrace{start: start}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			ut.getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			ut.gotConn = true
+			ut.connReused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			ut.firstByte = time.Now()
+		},
+	}
+	ctx := httptrace.WithClientTrace(r.Context(), trace)
+	ctx = context.WithValue(ctx, upstreamTraceKey{}, ut)
+	return r.WithContext(ctx), ut
+}
+
+// serverTiming が有効なら、プロキシ内の処理時間とバックエンドの応答時間を Server-Timing で返す
+// upstream は接続の取得から最初のバイトまで、proxy はそれ以外の時間
+func setServerTiming(response *http.Response) {
+	if !config.ServerTiming {
+		return
+	}
+	ut, ok := response.Request.Context().Value(upstreamTraceKey{}).(*upstreamTrace)
+	if !ok || ut.getConn.IsZero() || ut.firstByte.IsZero() {
+		return
+	}
+	upstream := ut.firstByte.Sub(ut.getConn)
+	proxy := time.Since(ut.start) - upstream
+	response.Header.Set("Server-Timing", fmt.Sprintf("proxy;dur=%.1f, upstream;dur=%.1f", milliseconds(proxy), milliseconds(upstream)))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// アクセスログの outcome。リクエストがどう終わったかを返す
+// タイムアウトやクライアントの切断でもエラーページは書かれるので、そちらを先に見る
+func requestOutcome(r *http.Request, ut *upstreamTrace) string {
+	switch {
+	case requestTimedOut(r.Context()):
+		return "timeout"
+	case r.Context().Err() != nil:
+		return "client_aborted"
+	case ut.faultInjected:
+		return "fault_injected"
+	case ut.upstreamFailed:
+		return "upstream_error"
+	}
+	return "completed"
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLogConnReused(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+
+	serveProxy(appRequest("GET", "/", nil))
+	if got := lastAccessLog(t)["conn_reused"]; got != false {
+		t.Errorf("first request: conn_reused = %v", got)
+	}
+	serveProxy(appRequest("GET", "/", nil))
+	if got := lastAccessLog(t)["conn_reused"]; got != true {
+		t.Errorf("second request: conn_reused = %v", got)
+	}
+}
+
+func TestAccessLogWithoutUpstreamConn(t *testing.T) {
+	useConfig(t, `{"backends": {"app.test": {"url": "http://127.0.0.1:1", "maintenance": true}}}`)
+	if rec := serveProxy(appRequest("GET", "/", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d", rec.Code)
+	}
+	// バックエンドに接続していなければ conn_reused は出さない
+	if _, ok := lastAccessLog(t)["conn_reused"]; ok {
+		t.Error("conn_reused logged without an upstream connection")
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	backend := textBackend(t, "ok")
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}}`)
+	if got := serveProxy(appRequest("GET", "/", nil)).Header().Get("Server-Timing"); got != "" {
+		t.Errorf("Server-Timing without serverTiming: %q", got)
+	}
+
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "serverTiming": true}`)
+	got := serveProxy(appRequest("GET", "/", nil)).Header().Get("Server-Timing")
+	var proxyDur, upstreamDur float64
+	if _, err := fmt.Sscanf(got, "proxy;dur=%f, upstream;dur=%f", &proxyDur, &upstreamDur); err != nil {
+		t.Fatalf("Server-Timing = %q: %v", got, err)
+	}
+	if proxyDur < 0 || upstreamDur <= 0 {
+		t.Errorf("Server-Timing = %q", got)
+	}
+}
+
+func TestAccessLogOutcome(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/wait":
+			<-r.Context().Done()
+		case "/cut":
+			// Content-Length より短く書いて切る
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`", "down.test": "http://127.0.0.1:1"}}`)
+
+	serveProxy(appRequest("GET", "/", nil))
+	if got := lastAccessLog(t)["outcome"]; got != "completed" {
+		t.Errorf("completed request: outcome %v", got)
+	}
+
+	down := appRequest("GET", "/", nil)
+	down.Host = "down.test"
+	serveProxy(down)
+	if got := lastAccessLog(t)["outcome"]; got != "upstream_error" {
+		t.Errorf("unreachable backend: outcome %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	serveProxy(appRequest("GET", "/wait", nil).WithContext(ctx))
+	if got := lastAccessLog(t)["outcome"]; got != "client_aborted" {
+		t.Errorf("client went away: outcome %v", got)
+	}
+
+	// 本文の途中で切れると ReverseProxy は ErrAbortHandler で抜けるが、ログは残る
+	// ErrAbortHandler になるのは http.Server から呼ばれたときだけ
+	proxy := newProxyServer(t)
+	req, _ := http.NewRequest("GET", proxy.URL+"/cut", nil)
+	req.Host = "app.test"
+	// ヘッダーが送られる前に切れることもあるので、クライアント側のエラーの出方は問わない
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if entry := lastAccessLog(t); entry["outcome"] != "aborted" || entry["path"] != "/cut" {
+		t.Errorf("cut response: access log %v", entry)
+	}
+}
+
+func TestAccessLogOutcomeTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": "`+backend.URL+`"}, "requestTimeout": 1}`)
+	serveProxy(appRequest("GET", "/", nil))
+	if got := lastAccessLog(t)["outcome"]; got != "timeout" {
+		t.Errorf("outcome %v, want timeout", got)
+	}
+}
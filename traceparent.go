@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// W3C Trace Context の traceparent をバックエンドに渡し、トレース ID を返す
+// 正しい traceparent を受け取ったらそのトレースを続け、なければ新しく始める
+// スパン ID はプロキシのものに付け替える
+func propagateTraceparent(r *http.Request) string {
+	traceID, flags, ok := parseTraceparent(r.Header.Get("Traceparent"))
+	if !ok {
+		traceID = randomHex(16)
+		flags = "01"
+		r.Header.Del("Tracestate")
+	}
+	r.Header.Set("Traceparent", "00-"+traceID+"-"+randomHex(8)+"-"+flags)
+	return traceID
+}
+
+// version-traceid-parentid-flags。すべて 0 の ID は無効
+func parseTraceparent(value string) (traceID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isLowerHex(parts[0]) || !isLowerHex(traceID) || len(traceID) != 32 || !isLowerHex(parentID) || len(parentID) != 16 || !isLowerHex(flags) || len(flags) != 2 {
+		return "", "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, flags, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
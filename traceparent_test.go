@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for value, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true, // 新しいバージョンは後ろに増えてよい
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":          false,
+		"": false,
+	} {
+		if _, _, got := parseTraceparent(value); got != ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", value, got, ok)
+		}
+	}
+}
+
+func TestPropagateTraceparent(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "propagateTraceparent": true}}}`)
+
+	// 受け取ったトレースを続け、スパン ID だけを付け替える
+	r := appRequest("GET", "/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	r.Header.Set("Tracestate", "vendor=1")
+	serveProxy(r)
+	traceID, flags, ok := parseTraceparent(got.Get("Traceparent"))
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "00" || strings.Contains(got.Get("Traceparent"), "00f067aa0ba902b7") {
+		t.Errorf("backend got traceparent %q", got.Get("Traceparent"))
+	}
+	if got.Get("Tracestate") != "vendor=1" {
+		t.Errorf("tracestate was not kept: %q", got.Get("Tracestate"))
+	}
+	if entry := lastAccessLog(t); entry["trace_id"] != traceID {
+		t.Errorf("access log trace_id = %v", entry["trace_id"])
+	}
+
+	// 壊れた traceparent は新しいトレースに置き換え、tracestate も捨てる
+	r = appRequest("GET", "/", nil)
+	r.Header.Set("Traceparent", "garbage")
+	r.Header.Set("Tracestate", "vendor=1")
+	serveProxy(r)
+	traceID, flags, ok = parseTraceparent(got.Get("Traceparent"))
+	if !ok || traceID == "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "01" || got.Get("Tracestate") != "" {
+		t.Errorf("backend got traceparent %q, tracestate %q", got.Get("Traceparent"), got.Get("Tracestate"))
+	}
+}
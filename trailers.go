@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+// トレーラーは ReverseProxy がそのままクライアントに送る
+// stripTrailers は送らず、logTrailers は値をログに残す
+func handleTrailers(response *http.Response, backend Backend) {
+	if len(backend.StripTrailers) == 0 && len(backend.LogTrailers) == 0 {
+		return
+	}
+	// 宣言の段階で消しておき、クライアントに Trailer ヘッダーで予告しない
+	for _, name := range backend.StripTrailers {
+		response.Trailer.Del(name)
+	}
+	response.Body = &trailerBody{ReadCloser: response.Body, response: response, backend: backend}
+}
+
+// トレーラーの値は本文を読み終えたところで届く
+type trailerBody struct {
+	io.ReadCloser
+	response *http.Response
+	backend  Backend
+	done     bool
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		for _, name := range b.backend.LogTrailers {
+			if values := b.response.Trailer.Values(name); len(values) > 0 {
+				log.Printf("Trailer %s from %s: %q", name, b.response.Request.URL.Host, values)
+			}
+		}
+		for _, name := range b.backend.StripTrailers {
+			b.response.Trailer.Del(name)
+		}
+	}
+	return n, err
+}
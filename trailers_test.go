@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripAndLogTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, X-Internal-Cost")
+		w.Write([]byte("body"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("X-Internal-Cost", "42")
+	}))
+	defer backend.Close()
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "stripTrailers": ["X-Internal-Cost"], "logTrailers": ["X-Internal-Cost"]}}}`)
+	proxy := newProxyServer(t)
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "app.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if _, ok := resp.Trailer["X-Internal-Cost"]; ok {
+		t.Errorf("stripped trailer reached the client: %v", resp.Trailer)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("trailers = %v", resp.Trailer)
+	}
+	if len(logsWithMessage(t, `Trailer X-Internal-Cost from `+backend.Listener.Addr().String()+`: ["42"]`)) != 1 {
+		t.Errorf("log = %s", testLog.String())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ReverseProxy は Upgrade をそのまま中継するので、ここでは数えるだけ
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxWebSocketConns を超えていたら 503 を返して false を返す
+// true のときは接続が閉じた後に release を呼ぶ
+func (rt *route) acquireWebSocket(w http.ResponseWriter, r *http.Request) bool {
+	if rt.webSockets.Add(1) > int64(rt.backend.MaxWebSocketConns) {
+		rt.webSockets.Add(-1)
+		log.Printf("Rejected WebSocket upgrade from %s: %d connections already open", r.RemoteAddr, rt.backend.MaxWebSocketConns)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (rt *route) releaseWebSocket() {
+	rt.webSockets.Add(-1)
+}
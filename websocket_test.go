@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 101 を返してから受け取ったものをそのまま返すバックエンド
+func upgradeBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// プロキシに WebSocket の Upgrade を送り、ステータスと開いたままの接続を返す
+func dialWebSocket(t *testing.T, proxy *httptest.Server) (int, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: app.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, conn
+}
+
+func TestMaxWebSocketConns(t *testing.T) {
+	backend := upgradeBackend(t)
+	useConfig(t, `{"backends": {"app.test": {"url": "`+backend.URL+`", "maxWebSocketConns": 1}}}`)
+	proxy := newProxyServer(t)
+
+	status, first := dialWebSocket(t, proxy)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("first upgrade: got %d", status)
+	}
+	status, second := dialWebSocket(t, proxy)
+	second.Close()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("upgrade over the limit: got %d, want 503", status)
+	}
+
+	// 閉じたら枠が空く
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, conn := dialWebSocket(t, proxy)
+		conn.Close()
+		if status == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upgrade after closing the first connection: got %d", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}